@@ -0,0 +1,233 @@
+// Package backlight dims a backlight wired to a plain GPIO pin. The PiBox's
+// GPIO22 is not one of the Pi's hardware PWM pins, so brightness is made by
+// switching the pin on and off in software.
+package backlight
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"periph.io/x/conn/v3/gpio"
+)
+
+// Max is the brightness of a backlight that is fully on
+const Max = 100
+
+// DefaultPeriod is the length of one PWM cycle. 200Hz is fast enough not to
+// flicker, and slow enough for the sleeps between switching the pin.
+const DefaultPeriod = 5 * time.Millisecond
+
+// fade is a change of brightness in progress
+type fade struct {
+	from, to int
+	start    time.Time
+	duration time.Duration
+}
+
+// at returns the brightness of the fade at t, and whether it is over
+func (f *fade) at(t time.Time) (int, bool) {
+	elapsed := t.Sub(f.start)
+	if elapsed >= f.duration {
+		return f.to, true
+	}
+	return f.from + int(int64(f.to-f.from)*int64(elapsed)/int64(f.duration)), false
+}
+
+// Backlight drives a backlight pin. Brightness is 0 to Max, anything in
+// between is made with software PWM on a goroutine of its own.
+type Backlight struct {
+	pin    gpio.PinOut
+	period time.Duration
+
+	mu    sync.Mutex
+	level int
+	fade  *fade
+	// restore is the brightness On goes back to
+	restore int
+	closed  bool
+	// failed is set once an error switching the pin was reported
+	failed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// New starts driving pin at brightness level, with a PWM cycle of period
+func New(pin gpio.PinOut, level int, period time.Duration) *Backlight {
+	b := &Backlight{
+		pin:     pin,
+		period:  period,
+		level:   clamp(level),
+		restore: Max,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if b.level > 0 {
+		b.restore = b.level
+	}
+	go b.run()
+	return b
+}
+
+func clamp(level int) int {
+	switch {
+	case level < 0:
+		return 0
+	case level > Max:
+		return Max
+	}
+	return level
+}
+
+// signal wakes the PWM goroutine up to pick up a change
+func (b *Backlight) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Set changes the brightness at once, stopping any fade
+func (b *Backlight) Set(level int) {
+	b.Fade(level, 0)
+}
+
+// Fade changes the brightness gradually over d, starting from wherever it is
+// now
+func (b *Backlight) Fade(level int, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.settleLocked(now)
+	level = clamp(level)
+	if d <= 0 || level == b.level {
+		b.level, b.fade = level, nil
+	} else {
+		b.fade = &fade{from: b.level, to: level, start: now, duration: d}
+	}
+	if level > 0 {
+		b.restore = level
+	}
+	b.signal()
+}
+
+// Off fades the backlight out over d. On brings it back to where it was.
+func (b *Backlight) Off(d time.Duration) {
+	b.Fade(0, d)
+}
+
+// On fades the backlight in over d, to the last brightness above 0
+func (b *Backlight) On(d time.Duration) {
+	b.mu.Lock()
+	restore := b.restore
+	b.mu.Unlock()
+	b.Fade(restore, d)
+}
+
+// settleLocked moves the brightness along the fade in progress
+func (b *Backlight) settleLocked(t time.Time) {
+	if b.fade == nil {
+		return
+	}
+	level, over := b.fade.at(t)
+	b.level = level
+	if over {
+		b.fade = nil
+	}
+}
+
+// Level returns the brightness right now, part of the way through a fade
+func (b *Backlight) Level() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settleLocked(time.Now())
+	return b.level
+}
+
+// Target returns the brightness the backlight is at or fading to
+func (b *Backlight) Target() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fade != nil {
+		return b.fade.to
+	}
+	return b.level
+}
+
+// Fading reports whether a fade is in progress
+func (b *Backlight) Fading() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settleLocked(time.Now())
+	return b.fade != nil
+}
+
+// out switches the pin, reporting the first failure
+func (b *Backlight) out(l gpio.Level) {
+	if err := b.pin.Out(l); err != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if !b.failed {
+			b.failed = true
+			fmt.Fprintf(os.Stderr, "Could not switch backlight %s: %v\n", b.pin, err)
+		}
+	}
+}
+
+func (b *Backlight) run() {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		b.settleLocked(time.Now())
+		level, fading, closed := b.level, b.fade != nil, b.closed
+		b.mu.Unlock()
+		if closed {
+			return
+		}
+
+		if !fading && (level == 0 || level == Max) {
+			// a steady pin needs no switching until something changes
+			if level == 0 {
+				b.out(gpio.Low)
+			} else {
+				b.out(gpio.High)
+			}
+			<-b.wake
+			continue
+		}
+
+		on := b.period * time.Duration(level) / Max
+		if on > 0 {
+			b.out(gpio.High)
+			time.Sleep(on)
+		}
+		if on < b.period {
+			b.out(gpio.Low)
+			time.Sleep(b.period - on)
+		}
+	}
+}
+
+// Close stops the PWM goroutine. The pin is left on if the backlight was at
+// all bright, and off otherwise.
+func (b *Backlight) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.settleLocked(time.Now())
+	b.fade = nil
+	b.closed = true
+	level := b.level
+	b.mu.Unlock()
+	b.signal()
+	<-b.done
+	if level > 0 {
+		b.out(gpio.High)
+	} else {
+		b.out(gpio.Low)
+	}
+}
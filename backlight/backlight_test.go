@@ -0,0 +1,173 @@
+package backlight
+
+import (
+	"testing"
+	"time"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpiotest"
+)
+
+const testPeriod = time.Millisecond
+
+// countingPin counts how often the backlight switched it each way
+type countingPin struct {
+	gpiotest.Pin
+	highs, lows int
+}
+
+func (p *countingPin) Out(l gpio.Level) error {
+	p.Lock()
+	if l == gpio.High {
+		p.highs++
+	} else {
+		p.lows++
+	}
+	p.Unlock()
+	return p.Pin.Out(l)
+}
+
+func (p *countingPin) switches() (highs, lows int) {
+	p.Lock()
+	defer p.Unlock()
+	return p.highs, p.lows
+}
+
+func newTestBacklight(t *testing.T, level int) (*Backlight, *countingPin) {
+	pin := &countingPin{Pin: gpiotest.Pin{N: "BL", Num: 22}}
+	b := New(pin, level, testPeriod)
+	t.Cleanup(b.Close)
+	return b, pin
+}
+
+// holds checks the pin settles at l, and is then left there for many PWM
+// cycles
+func holds(t *testing.T, pin *countingPin, l gpio.Level) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; {
+		highs, lows := pin.switches()
+		time.Sleep(20 * testPeriod)
+		nowHighs, nowLows := pin.switches()
+		if pin.Read() == l && nowHighs == highs && nowLows == lows {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pin never held %s", l)
+		}
+	}
+}
+
+// toggles checks the pin keeps switching between high and low
+func toggles(t *testing.T, pin *countingPin) {
+	t.Helper()
+	highs, lows := pin.switches()
+	for deadline := time.Now().Add(time.Second); ; {
+		h, l := pin.switches()
+		if h >= highs+3 && l >= lows+3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pin switched high %d and low %d times, want it toggling", h-highs, l-lows)
+		}
+		time.Sleep(testPeriod)
+	}
+}
+
+func TestSteadyLevels(t *testing.T) {
+	b, pin := newTestBacklight(t, 0)
+	holds(t, pin, gpio.Low)
+	b.Set(Max)
+	holds(t, pin, gpio.High)
+	b.Set(0)
+	holds(t, pin, gpio.Low)
+}
+
+func TestPWM(t *testing.T) {
+	b, pin := newTestBacklight(t, 50)
+	toggles(t, pin)
+	b.Set(Max)
+	holds(t, pin, gpio.High)
+	b.Set(10)
+	toggles(t, pin)
+}
+
+func TestLevel(t *testing.T) {
+	b, _ := newTestBacklight(t, 70)
+	for _, tt := range []struct{ set, want int }{
+		{37, 37},
+		{0, 0},
+		{Max, Max},
+		{-5, 0},
+		{Max + 50, Max},
+	} {
+		b.Set(tt.set)
+		if got := b.Level(); got != tt.want {
+			t.Errorf("Set(%d): Level() = %d, want %d", tt.set, got, tt.want)
+		}
+		if got := b.Target(); got != tt.want {
+			t.Errorf("Set(%d): Target() = %d, want %d", tt.set, got, tt.want)
+		}
+	}
+
+	// On goes back to the last brightness above 0
+	b.Set(42)
+	b.Off(0)
+	if got := b.Level(); got != 0 {
+		t.Errorf("after Off, Level() = %d, want 0", got)
+	}
+	b.On(0)
+	if got := b.Level(); got != 42 {
+		t.Errorf("after On, Level() = %d, want 42", got)
+	}
+}
+
+func TestFade(t *testing.T) {
+	b, pin := newTestBacklight(t, 0)
+	b.Fade(Max, 50*time.Millisecond)
+	if got := b.Target(); got != Max {
+		t.Errorf("Target() = %d while fading, want %d", got, Max)
+	}
+	for deadline := time.Now().Add(time.Second); b.Fading(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the fade never ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := b.Level(); got != Max {
+		t.Errorf("Level() = %d after the fade, want %d", got, Max)
+	}
+	holds(t, pin, gpio.High)
+}
+
+func TestStopFade(t *testing.T) {
+	b, pin := newTestBacklight(t, Max)
+	b.Fade(0, time.Hour)
+	if !b.Fading() {
+		t.Fatal("Fading() = false, want true")
+	}
+
+	// setting the level on the way stops the fade there
+	b.Set(30)
+	if b.Fading() {
+		t.Error("Fading() = true after Set, want false")
+	}
+	time.Sleep(10 * testPeriod)
+	if got := b.Level(); got != 30 {
+		t.Errorf("Level() = %d after Set, want 30", got)
+	}
+	if got := b.Target(); got != 30 {
+		t.Errorf("Target() = %d after Set, want 30", got)
+	}
+	toggles(t, pin)
+
+	// and so does closing, which leaves the pin on
+	b.Fade(0, time.Hour)
+	b.Close()
+	if b.Fading() {
+		t.Error("Fading() = true after Close, want false")
+	}
+	if got := b.Level(); got == 0 {
+		t.Error("Level() = 0 after Close, want the level the fade had reached")
+	}
+	holds(t, pin, gpio.High)
+}
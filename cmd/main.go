@@ -1,77 +1,325 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	// "time"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/kubesail/pibox-framebuffer/display"
 	pfb "github.com/kubesail/pibox-framebuffer/pkg"
 	_ "github.com/kubesail/pibox-framebuffer/statik"
 
-	"github.com/stianeikeland/go-rpio/v4"
+	// QUIET_TIMEZONE works without the system's zoneinfo
+	_ "time/tzdata"
 )
 
 const DefaultDiskMountPrefix = "/var/lib/rancher"
 const DefaultListenHost = "localhost"
 const DefaultListenPort = "2019"
+const DefaultSocketPath = "/var/run/pibox/framebuffer.sock"
+const DefaultSocketMode = "0660"
+const DefaultDisplayBackend = display.BackendSPI
+const DefaultShutdownBacklight = "on"
+const DefaultBacklight = 100
+const DefaultRenderQueueSize = pfb.DefaultQueueSize
+const DefaultStats = "off"
+
+// ShutdownTimeout is how long in-flight requests get to finish on shutdown
+const ShutdownTimeout = 10 * time.Second
 
 func main() {
+	displayBackend, ok := os.LookupEnv("DISPLAY_BACKEND")
+	if !ok {
+		displayBackend = DefaultDisplayBackend
+	}
+	flag.StringVar(&displayBackend, "display", displayBackend, "display backend, \"spi\" for the PiBox panel or \"memory\" to run without one")
+	flag.Parse()
+
+	if err := display.SetBackend(displayBackend); err != nil {
+		log.Fatal(err)
+	}
+
 	listenHost, ok := os.LookupEnv("HOST")
 	if !ok {
 		listenHost = DefaultListenHost
 	}
 
+	// PORT= (empty) disables the TCP listener
 	listenPort, ok := os.LookupEnv("PORT")
 	if !ok {
 		listenPort = DefaultListenPort
 	}
-	
+
+	// SOCKET_PATH= (empty) disables the unix socket listener
+	socketPath, ok := os.LookupEnv("SOCKET_PATH")
+	if !ok {
+		socketPath = DefaultSocketPath
+	}
+
+	socketModeEnv, ok := os.LookupEnv("SOCKET_MODE")
+	if !ok {
+		socketModeEnv = DefaultSocketMode
+	}
+	socketMode, err := strconv.ParseUint(socketModeEnv, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid SOCKET_MODE %q: %v", socketModeEnv, err)
+	}
+
+	socketGroup := os.Getenv("SOCKET_GROUP")
+
 	diskMountPrefix, ok := os.LookupEnv("DISK_MOUNT_PREFIX")
 	if !ok {
 		diskMountPrefix = DefaultDiskMountPrefix
 	}
 
-	buffer := pfb.NewFrameBuffer(pfb.DefaultScreenSize, true, diskMountPrefix)
+	shutdownFrame, ok := os.LookupEnv("SHUTDOWN_FRAME")
+	if !ok {
+		shutdownFrame = pfb.DefaultShutdownFrame
+	}
 
-	err := rpio.Open()
-	if err == nil {
-		backlight := rpio.Pin(22)
-		backlight.Output() // Output mode
-		backlight.High()   // Set pin High
-		buffer.Splash()
-		// time.AfterFunc(6*time.Second, stats)
-		// time.AfterFunc(0*time.Second, buffer.Stats)
-	} else {
-		fmt.Fprintf(os.Stderr, "Could not connect to framebuffer screen: %v\n", err)
+	shutdownBacklight, ok := os.LookupEnv("SHUTDOWN_BACKLIGHT")
+	if !ok {
+		shutdownBacklight = DefaultShutdownBacklight
+	}
+	if shutdownBacklight != "on" && shutdownBacklight != "off" {
+		log.Fatalf("Invalid SHUTDOWN_BACKLIGHT %q, use on or off", shutdownBacklight)
 	}
 
-	exit := func(http.ResponseWriter, *http.Request) {
-		buffer.Exit()
-		os.Exit(0)
+	brightness := DefaultBacklight
+	if v, ok := os.LookupEnv("BACKLIGHT"); ok {
+		brightness, err = strconv.Atoi(v)
+		if err != nil || brightness < 0 || brightness > 100 {
+			log.Fatalf("Invalid BACKLIGHT %q, use a number from 0 to 100", v)
+		}
 	}
 
-	// http.HandleFunc("/rgb", buffer.RGB)
-	http.HandleFunc("/image", buffer.DrawImage)
-	// http.HandleFunc("/gif", buffer.DrawGIF)
-	// http.HandleFunc("/text", buffer.TextRequest)
-	// http.HandleFunc("/stats/on", buffer.EnableStats)
-	// http.HandleFunc("/qr", buffer.QR)
-	// http.HandleFunc("/disk-stats", buffer.DiskStats)
-	http.HandleFunc("/exit", exit)
+	backlightFade := pfb.DefaultBacklightFade
+	if v, ok := os.LookupEnv("BACKLIGHT_FADE"); ok {
+		backlightFade, err = time.ParseDuration(v)
+		if err != nil || backlightFade < 0 {
+			log.Fatalf("Invalid BACKLIGHT_FADE %q, use a duration like 300ms", v)
+		}
+	}
+
+	var idleTimeout time.Duration
+	if v, ok := os.LookupEnv("IDLE_TIMEOUT"); ok {
+		idleTimeout, err = time.ParseDuration(v)
+		if err != nil || idleTimeout < 0 {
+			log.Fatalf("Invalid IDLE_TIMEOUT %q, use a duration like 10m, or 0 to stay on", v)
+		}
+	}
 
-	fmt.Printf("PiBox Framebuffer listening on %s:%s\n", listenHost, listenPort)
-	// listen on localhost only	
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", listenHost, listenPort))
+	quietLocation := time.Local
+	if v := os.Getenv("QUIET_TIMEZONE"); v != "" {
+		quietLocation, err = time.LoadLocation(v)
+		if err != nil {
+			log.Fatalf("Invalid QUIET_TIMEZONE %q: %v", v, err)
+		}
+	}
+	quietHours, err := pfb.ParseQuietHours(os.Getenv("QUIET_HOURS"), quietLocation)
 	if err != nil {
-		log.Fatalf("Could not listen on %s:%s, %v", listenPort, err)
-		return
+		log.Fatalf("Invalid QUIET_HOURS: %v", err)
+	}
+
+	var quietBrightness int
+	if v, ok := os.LookupEnv("QUIET_BRIGHTNESS"); ok {
+		quietBrightness, err = strconv.Atoi(v)
+		if err != nil || quietBrightness < 0 || quietBrightness > 100 {
+			log.Fatalf("Invalid QUIET_BRIGHTNESS %q, use a number from 0 to 100", v)
+		}
 	}
-	defer listener.Close()
 
-	if err = http.Serve(listener, nil); err != nil {
+	queueSize := DefaultRenderQueueSize
+	if v, ok := os.LookupEnv("RENDER_QUEUE_SIZE"); ok {
+		queueSize, err = strconv.Atoi(v)
+		if err != nil || queueSize < 1 {
+			log.Fatalf("Invalid RENDER_QUEUE_SIZE %q, use a positive number", v)
+		}
+	}
+
+	stats, ok := os.LookupEnv("STATS")
+	if !ok {
+		stats = DefaultStats
+	}
+	if stats != "on" && stats != "off" {
+		log.Fatalf("Invalid STATS %q, use on or off", stats)
+	}
+
+	statsWidgets := pfb.DefaultStatsWidgets
+	if v, ok := os.LookupEnv("STATS_WIDGETS"); ok {
+		statsWidgets, err = pfb.ParseStatsWidgets(v)
+		if err != nil {
+			log.Fatalf("Invalid STATS_WIDGETS %q: %v", v, err)
+		}
+	}
+
+	statsInterval := pfb.DefaultStatsInterval
+	if v, ok := os.LookupEnv("STATS_INTERVAL"); ok {
+		statsInterval, err = time.ParseDuration(v)
+		if err != nil || statsInterval <= 0 {
+			log.Fatalf("Invalid STATS_INTERVAL %q, use a duration like 3s", v)
+		}
+	}
+
+	statsThresholds, err := pfb.ParseStatsThresholds(os.Getenv("STATS_THRESHOLDS"))
+	if err != nil {
+		log.Fatalf("Invalid STATS_THRESHOLDS: %v", err)
+	}
+
+	var statsInterfaces []string
+	for _, name := range strings.Split(os.Getenv("STATS_INTERFACES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			statsInterfaces = append(statsInterfaces, name)
+		}
+	}
+
+	fontsDir, ok := os.LookupEnv("FONTS_DIR")
+	if !ok {
+		fontsDir = pfb.DefaultFontsDir
+	}
+	fontFamily, ok := os.LookupEnv("FONT_FAMILY")
+	if !ok {
+		fontFamily = pfb.DefaultFontFamily
+	}
+
+	diskReportTTL := pfb.DefaultDiskReportTTL
+	if v, ok := os.LookupEnv("DISK_REPORT_TTL"); ok {
+		diskReportTTL, err = time.ParseDuration(v)
+		if err != nil || diskReportTTL < 0 {
+			log.Fatalf("Invalid DISK_REPORT_TTL %q, use a duration like 1m", v)
+		}
+	}
+
+	buffer := pfb.NewFrameBuffer(pfb.DefaultScreenSize, stats == "on", diskMountPrefix,
+		pfb.WithShutdownFrame(shutdownFrame),
+		pfb.WithShutdownBacklight(shutdownBacklight == "on"),
+		pfb.WithBacklight(brightness),
+		pfb.WithBacklightFade(backlightFade),
+		pfb.WithIdleTimeout(idleTimeout),
+		pfb.WithQuietHours(quietHours, quietBrightness),
+		pfb.WithQueueSize(queueSize),
+		pfb.WithStatsWidgets(statsWidgets),
+		pfb.WithStatsInterval(statsInterval),
+		pfb.WithStatsThresholds(statsThresholds),
+		pfb.WithStatsInterfaces(statsInterfaces),
+		pfb.WithFontsDir(fontsDir),
+		pfb.WithFontFamily(fontFamily),
+		pfb.WithDiskReportTTL(diskReportTTL),
+	)
+
+	if err := buffer.Splash(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not draw splash screen: %v\n", err)
+	} else if err := buffer.StartBacklight(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set backlight: %v\n", err)
+	}
+	buffer.StartQuietHours()
+
+	var exitOnce sync.Once
+	exitRequested := make(chan struct{})
+	exit := func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "Shutting down\n")
+		exitOnce.Do(func() { close(exitRequested) })
+	}
+
+	// handle serves h at pattern, counting its requests in /metrics
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.Handle(pattern, buffer.Instrument(pattern, h))
+	}
+
+	// handle("/rgb", buffer.RGB)
+	handle("/image", buffer.DrawImage)
+	handle("/screenshot", buffer.Screenshot)
+	handle("/stats", buffer.DisplayStats)
+	handle("/stats/on", buffer.EnableStats)
+	handle("/stats/off", buffer.DisableStats)
+	handle("/animation", buffer.Animation)
+	handle("/layers", buffer.Layers)
+	handle("/layers/", buffer.Layer)
+	handle("/notify", buffer.Notify)
+	handle("/render", buffer.Render)
+	handle("/carousel", buffer.Carousel)
+	handle("/carousel/", buffer.CarouselPath)
+	handle("/text", buffer.TextRequest)
+	handle("/fonts", buffer.Fonts)
+	handle("/screens", buffer.Screens)
+	handle("/screens/", buffer.Screen)
+	handle("/qr", buffer.QR)
+	handle("/disk-stats", buffer.DiskStats)
+	handle("/backlight", buffer.Backlight)
+	handle("/sleep", buffer.Sleep)
+	handle("/wake", buffer.Wake)
+	handle("/quiet-hours", buffer.QuietHours)
+	handle("/quiet-hours/wake", buffer.WakeQuietHours)
+	handle("/metrics", buffer.Metrics)
+	handle("/exit", exit)
+
+	var listeners []net.Listener
+	if listenPort != "" {
+		// listen on localhost only by default
+		listener, err := net.Listen("tcp", net.JoinHostPort(listenHost, listenPort))
+		if err != nil {
+			log.Fatalf("Could not listen on %s:%s, %v", listenHost, listenPort, err)
+		}
+		fmt.Printf("PiBox Framebuffer listening on %s:%s\n", listenHost, listenPort)
+		listeners = append(listeners, listener)
+	}
+
+	if socketPath != "" {
+		listener, err := pfb.ListenUnix(socketPath, os.FileMode(socketMode), socketGroup)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			log.Fatalf("Could not listen on %s, %v", socketPath, err)
+		}
+		fmt.Printf("PiBox Framebuffer listening on %s\n", socketPath)
+		listeners = append(listeners, listener)
+	}
+
+	if len(listeners) == 0 {
+		log.Fatal("No listeners configured, set PORT and/or SOCKET_PATH")
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	server := &http.Server{}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+
+	select {
+	case sig := <-signals:
+		fmt.Fprintf(os.Stderr, "Received %v, shutting down...\n", sig)
+	case <-exitRequested:
+		fmt.Fprintln(os.Stderr, "Received exit request, shutting down...")
+	case err := <-errs:
+		// closing the server also removes the unix socket
+		server.Close()
 		log.Fatalf("Could not start HTTP server: %v", err)
 	}
+
+	// stop accepting connections and wait for in-flight draws to finish
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not drain HTTP requests: %v\n", err)
+	}
+
+	if err := buffer.Shutdown(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not shut down display: %v\n", err)
+	}
 }
@@ -1,18 +1,17 @@
 package display
 
 import (
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
-	"log"
 	"sync"
+	"time"
 
-	"github.com/kubesail/pibox-framebuffer/st7789"
-	"periph.io/x/conn/v3/driver/driverreg"
-	"periph.io/x/conn/v3/gpio/gpioreg"
-	"periph.io/x/conn/v3/spi"
-	"periph.io/x/conn/v3/spi/spireg"
-	"periph.io/x/host/v3"
+	"github.com/kubesail/pibox-framebuffer/backlight"
+	"github.com/kubesail/pibox-framebuffer/metrics"
+	"periph.io/x/conn/v3/gpio"
 )
 
 type Rotation uint8
@@ -24,71 +23,261 @@ const (
 	ROTATION_270 Rotation = 3
 )
 
+// Names of the available display backends
+const (
+	BackendSPI    = "spi"
+	BackendMemory = "memory"
+)
+
+// Backend is the device a Display draws to
+type Backend interface {
+	Bounds() image.Rectangle
+	DrawRAW(img image.Image) error
+	DrawRegion(rect image.Rectangle, img image.Image) error
+	FillScreen(c color.RGBA) error
+	SetPixel(x int16, y int16, c color.RGBA) error
+	SetRotation(rotation Rotation) error
+	// BacklightPin is the pin the backlight is wired to
+	BacklightPin() gpio.PinOut
+	// Sleep switches the panel off to save power, Wake switches it back on
+	// showing the last frame drawn
+	Sleep() error
+	Wake() error
+	Close() error
+}
+
+// Stats counts the pixel data a backend sent to its device
+type Stats struct {
+	Frames     uint64
+	Regions    uint64
+	BytesSent  uint64
+	BytesSaved uint64
+
+	Transfers      uint64
+	TransferErrors uint64
+
+	// Convert and Transfer are how long frames took to convert to the
+	// device's format and to send, in seconds
+	Convert  metrics.HistogramSnapshot
+	Transfer metrics.HistogramSnapshot
+}
+
+// statser is implemented by backends that track what they send
+type statser interface {
+	Stats() Stats
+}
+
 var once sync.Once
 var display *Display
+var initErr error
+var backendName = BackendSPI
 
 type Display struct {
-	p   spi.PortCloser
-	dev *st7789.Device
-}
+	backend Backend
 
-func init() {
-	if _, err := host.Init(); err != nil {
-		log.Fatal(err)
-	}
+	// shadow is a copy of what is currently on the screen
+	shadowMu sync.Mutex
+	shadow   *image.RGBA
 
-	if _, err := driverreg.Init(); err != nil {
-		log.Fatal(err)
-	}
+	backlight *backlight.Backlight
+	// sleepBrightness is the brightness the backlight had before Sleep.
+	// It and asleep are not locked: Sleep, Wake, Brightness and
+	// SetBrightness must only be called from one goroutine at a time, which
+	// for the server is its render queue.
+	sleepBrightness int
+	asleep          bool
+}
 
+// SetBackend selects the backend opened by Init. It has no effect once the
+// display has been initialised.
+func SetBackend(name string) error {
+	switch name {
+	case BackendSPI, BackendMemory:
+		backendName = name
+		return nil
+	}
+	return fmt.Errorf("unknown display backend %q", name)
 }
 
+// Init opens the display on first use. A display that failed to open keeps
+// returning the same error.
 func Init() (*Display, error) {
-	var err error
 	once.Do(func() {
-		display = &Display{}
-		display.p, err = spireg.Open("SPI0.0")
-		if err != nil {
+		var backend Backend
+		switch backendName {
+		case BackendMemory:
+			backend = NewMemory(240, 240)
+		default:
+			backend, initErr = openSPI()
+		}
+		if initErr != nil {
 			return
 		}
-		// USE GPIO9 to send data/commands
-		// https://pinout.xyz/pinout/pirate_audio_line_out#
-		display.dev, err = st7789.NewSPI(display.p.(spi.Port), gpioreg.ByName("GPIO25"), &st7789.DefaultOpts)
+		display = &Display{
+			backend: backend,
+			shadow:  image.NewRGBA(backend.Bounds()),
+			// the panel comes up with the backlight fully on
+			backlight: backlight.New(backend.BacklightPin(), backlight.Max, backlight.DefaultPeriod),
+		}
+		draw.Draw(display.shadow, display.shadow.Rect, image.Black, image.Point{}, draw.Src)
 	})
 
-	return display, err
+	return display, initErr
+}
+
+// Backend returns the device the display draws to
+func (d *Display) Backend() Backend {
+	return d.backend
 }
 
-func (d *Display) Close() {
-	d.p.Close()
+func (d *Display) Close() error {
+	d.backlight.Close()
+	return d.backend.Close()
 }
 
-func (d *Display) DrawImage(reader io.Reader) {
-	d.dev.DrawImage(reader)
+// Backlight returns the display's backlight
+func (d *Display) Backlight() *backlight.Backlight {
+	return d.backlight
 }
 
-func (d *Display) DrawRAW(img image.Image) {
-	d.dev.DrawRAW(img)
+// Stats returns how much data the backend sent to the device. Backends that
+// do not track this report zeros.
+func (d *Display) Stats() Stats {
+	if s, ok := d.backend.(statser); ok {
+		return s.Stats()
+	}
+	return Stats{}
 }
 
-func (d *Display) Rotate(rotation Rotation) {
-	d.dev.SetRotation(st7789.Rotation(rotation))
+// Snapshot returns a copy of the frame currently on the screen
+func (d *Display) Snapshot() *image.RGBA {
+	d.shadowMu.Lock()
+	defer d.shadowMu.Unlock()
+	frame := image.NewRGBA(d.shadow.Rect)
+	copy(frame.Pix, d.shadow.Pix)
+	return frame
 }
 
-func (d *Display) FillScreen(c color.RGBA) {
-	d.dev.FillScreen(c)
+func (d *Display) DrawImage(reader io.Reader) error {
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return err
+	}
+	return d.DrawRAW(img)
 }
 
-func (d *Display) SetPixel(x int16, y int16, c color.RGBA) {
-	d.dev.SetPixel(x, y, c)
+func (d *Display) DrawRAW(img image.Image) error {
+	if bounds := d.backend.Bounds(); img.Bounds() != bounds {
+		// backends expect a full frame, draw anything else at the top left
+		frame := image.NewRGBA(bounds)
+		draw.Draw(frame, bounds, img, img.Bounds().Min, draw.Src)
+		img = frame
+	}
+	if err := d.backend.DrawRAW(img); err != nil {
+		return err
+	}
+	d.shadowMu.Lock()
+	// the panel ignores alpha, which is the same as drawing over black
+	draw.Draw(d.shadow, d.shadow.Rect, image.Black, image.Point{}, draw.Src)
+	draw.Draw(d.shadow, d.shadow.Rect, img, img.Bounds().Min, draw.Over)
+	d.shadowMu.Unlock()
+	return nil
 }
 
-// PowerOff the display
-func (d *Display) PowerOff() {
-	d.dev.PowerOff()
+// DrawRegion draws img into rect, leaving the rest of the screen untouched.
+// The top left of img is drawn at rect.Min.
+func (d *Display) DrawRegion(rect image.Rectangle, img image.Image) error {
+	if err := d.backend.DrawRegion(rect, img); err != nil {
+		return err
+	}
+	d.shadowMu.Lock()
+	draw.Draw(d.shadow, rect, image.Black, image.Point{}, draw.Src)
+	draw.Draw(d.shadow, rect, img, img.Bounds().Min, draw.Over)
+	d.shadowMu.Unlock()
+	return nil
 }
 
-// PowerOn the display
-func (d *Display) PowerOn() {
-	d.dev.PowerOn()
+func (d *Display) Rotate(rotation Rotation) error {
+	return d.backend.SetRotation(rotation)
+}
+
+func (d *Display) FillScreen(c color.RGBA) error {
+	if err := d.backend.FillScreen(c); err != nil {
+		return err
+	}
+	c.A = 255
+	d.shadowMu.Lock()
+	draw.Draw(d.shadow, d.shadow.Rect, &image.Uniform{c}, image.Point{}, draw.Src)
+	d.shadowMu.Unlock()
+	return nil
+}
+
+func (d *Display) SetPixel(x int16, y int16, c color.RGBA) error {
+	if err := d.backend.SetPixel(x, y, c); err != nil {
+		return err
+	}
+	c.A = 255
+	d.shadowMu.Lock()
+	d.shadow.SetRGBA(int(x), int(y), c)
+	d.shadowMu.Unlock()
+	return nil
+}
+
+// PowerOff switches the backlight off
+func (d *Display) PowerOff() error {
+	d.backlight.Off(0)
+	return nil
+}
+
+// PowerOn switches the backlight back on to the brightness it had
+func (d *Display) PowerOn() error {
+	d.backlight.On(0)
+	return nil
+}
+
+// Powered reports whether the backlight is on
+func (d *Display) Powered() bool {
+	return d.backlight.Level() > 0
+}
+
+// Sleep fades the backlight out over fade and puts the panel to sleep
+func (d *Display) Sleep(fade time.Duration) error {
+	d.sleepBrightness = d.backlight.Target()
+	d.backlight.Off(fade)
+	time.Sleep(fade)
+	if err := d.backend.Sleep(); err != nil {
+		return err
+	}
+	d.asleep = true
+	return nil
+}
+
+// Wake wakes the panel up, showing the last frame drawn, and fades the
+// backlight back in over fade
+func (d *Display) Wake(fade time.Duration) error {
+	if err := d.backend.Wake(); err != nil {
+		return err
+	}
+	d.asleep = false
+	d.backlight.Fade(d.sleepBrightness, fade)
+	return nil
+}
+
+// Brightness returns the brightness the backlight is at or fading to, or the
+// one Wake brings it back to while the panel sleeps
+func (d *Display) Brightness() int {
+	if d.asleep {
+		return d.sleepBrightness
+	}
+	return d.backlight.Target()
+}
+
+// SetBrightness fades the backlight to level over fade. While the panel
+// sleeps only the brightness Wake brings back changes.
+func (d *Display) SetBrightness(level int, fade time.Duration) {
+	if d.asleep {
+		d.sleepBrightness = level
+		return
+	}
+	d.backlight.Fade(level, fade)
 }
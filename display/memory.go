@@ -0,0 +1,143 @@
+package display
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/metrics"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpiotest"
+)
+
+// Memory is a software display that keeps the last frame in memory. It lets
+// the server run on machines without a panel attached.
+type Memory struct {
+	mu       sync.Mutex
+	frame    *image.RGBA
+	rotation Rotation
+	asleep   bool
+	// backlight is a fake pin, which can be read to see what the backlight
+	// would show
+	backlight *gpiotest.Pin
+
+	frames, regions uint64
+	// convertTime is how long copying frames took, so the metrics of a
+	// server without a panel are not all zeros
+	convertTime *metrics.Histogram
+}
+
+// NewMemory creates an in-memory display of the given size
+func NewMemory(width, height int) *Memory {
+	return &Memory{
+		frame:       image.NewRGBA(image.Rect(0, 0, width, height)),
+		backlight:   &gpiotest.Pin{N: "GPIO22", Num: 22},
+		convertTime: metrics.NewHistogram(metrics.DefaultLatencyBuckets),
+	}
+}
+
+// Frame returns a copy of the frame currently on the display
+func (m *Memory) Frame() *image.RGBA {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	frame := image.NewRGBA(m.frame.Rect)
+	copy(frame.Pix, m.frame.Pix)
+	return frame
+}
+
+// Rotation returns the rotation last set on the display
+func (m *Memory) Rotation() Rotation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rotation
+}
+
+// Asleep reports whether the display was put to sleep
+func (m *Memory) Asleep() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.asleep
+}
+
+// BacklightPin returns the fake pin standing in for GPIO22
+func (m *Memory) BacklightPin() gpio.PinOut {
+	return m.backlight
+}
+
+func (m *Memory) Bounds() image.Rectangle {
+	return m.frame.Rect
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Stats counts the frames and regions drawn. Nothing is transferred, so only
+// the conversion time is measured.
+func (m *Memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{
+		Frames:  m.frames,
+		Regions: m.regions,
+		Convert: m.convertTime.Snapshot(),
+	}
+}
+
+func (m *Memory) DrawRAW(img image.Image) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := time.Now()
+	draw.Draw(m.frame, m.frame.Rect, img, img.Bounds().Min, draw.Src)
+	m.convertTime.ObserveDuration(time.Since(start))
+	m.frames++
+	m.regions++
+	return nil
+}
+
+func (m *Memory) DrawRegion(rect image.Rectangle, img image.Image) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := time.Now()
+	draw.Draw(m.frame, rect, img, img.Bounds().Min, draw.Src)
+	m.convertTime.ObserveDuration(time.Since(start))
+	m.regions++
+	return nil
+}
+
+func (m *Memory) SetRotation(rotation Rotation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotation = rotation
+	return nil
+}
+
+func (m *Memory) FillScreen(c color.RGBA) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	draw.Draw(m.frame, m.frame.Rect, &image.Uniform{c}, image.Point{}, draw.Src)
+	return nil
+}
+
+func (m *Memory) SetPixel(x int16, y int16, c color.RGBA) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frame.SetRGBA(int(x), int(y), c)
+	return nil
+}
+
+func (m *Memory) Sleep() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.asleep = true
+	return nil
+}
+
+func (m *Memory) Wake() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.asleep = false
+	return nil
+}
@@ -0,0 +1,104 @@
+package display
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/kubesail/pibox-framebuffer/st7789"
+	"periph.io/x/conn/v3/driver/driverreg"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/spi"
+	"periph.io/x/conn/v3/spi/spireg"
+	"periph.io/x/host/v3"
+)
+
+// spiBackend drives the PiBox's ST7789 panel over SPI
+type spiBackend struct {
+	p         spi.PortCloser
+	dev       *st7789.Device
+	backlight gpio.PinOut
+}
+
+func openSPI() (*spiBackend, error) {
+	if _, err := host.Init(); err != nil {
+		return nil, err
+	}
+
+	if _, err := driverreg.Init(); err != nil {
+		return nil, err
+	}
+
+	b := &spiBackend{}
+	var err error
+	b.p, err = spireg.Open("SPI0.0")
+	if err != nil {
+		return nil, err
+	}
+	// USE GPIO9 to send data/commands
+	// https://pinout.xyz/pinout/pirate_audio_line_out#
+	b.dev, err = st7789.NewSPI(b.p.(spi.Port), gpioreg.ByName("GPIO25"), &st7789.DefaultOpts)
+	if err != nil {
+		b.p.Close()
+		return nil, err
+	}
+	// NewSPI made sure the pin exists
+	b.backlight = gpioreg.ByName("GPIO22")
+	return b, nil
+}
+
+func (b *spiBackend) Bounds() image.Rectangle {
+	return b.dev.Bounds()
+}
+
+func (b *spiBackend) Close() error {
+	return b.p.Close()
+}
+
+func (b *spiBackend) Stats() Stats {
+	s := b.dev.Stats()
+	return Stats{
+		Frames:     s.Frames,
+		Regions:    s.Regions,
+		BytesSent:  s.BytesSent,
+		BytesSaved: s.BytesSaved,
+
+		Transfers:      s.Transfers,
+		TransferErrors: s.TransferErrors,
+		Convert:        s.Convert,
+		Transfer:       s.Transfer,
+	}
+}
+
+func (b *spiBackend) DrawRAW(img image.Image) error {
+	return b.dev.DrawRAW(img)
+}
+
+func (b *spiBackend) DrawRegion(rect image.Rectangle, img image.Image) error {
+	return b.dev.DrawRegion(rect, img)
+}
+
+func (b *spiBackend) SetRotation(rotation Rotation) error {
+	return b.dev.SetRotation(st7789.Rotation(rotation))
+}
+
+func (b *spiBackend) Sleep() error {
+	return b.dev.Sleep()
+}
+
+func (b *spiBackend) Wake() error {
+	return b.dev.Wake()
+}
+
+func (b *spiBackend) FillScreen(c color.RGBA) error {
+	return b.dev.FillScreen(c)
+}
+
+func (b *spiBackend) SetPixel(x int16, y int16, c color.RGBA) error {
+	return b.dev.SetPixel(x, y, c)
+}
+
+// BacklightPin returns GPIO22, which the panel's backlight is wired to
+func (b *spiBackend) BacklightPin() gpio.PinOut {
+	return b.backlight
+}
@@ -4,14 +4,12 @@ go 1.16
 
 require github.com/gonutz/framebuffer v1.0.0
 
-require github.com/stianeikeland/go-rpio/v4 v4.6.0
-
 require github.com/rakyll/statik v0.1.7
 
 require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/fogleman/gg v1.3.0
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.7.1 // indirect
@@ -0,0 +1,487 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaxAnimationSize is the largest animation accepted by /animation
+const MaxAnimationSize = 32 << 20
+
+// MaxAnimationFrames is the most frames an animation may have
+const MaxAnimationFrames = 1000
+
+// MaxAnimationSide and MaxAnimationPixels bound the canvas and the frames of
+// an animation. They are checked against the file's headers before anything
+// is decoded.
+const (
+	MaxAnimationSide   = 4096
+	MaxAnimationPixels = 4 << 20
+)
+
+// MaxAnimationMemory is how much memory the frames of an animation may take
+// up once laid out for the screen, where each takes a full screen of RGBA
+const MaxAnimationMemory = 32 << 20
+
+// MaxAnimationDecoded is how much memory the frames of an animation may take
+// up as decoded from the file, before they are laid out
+const MaxAnimationDecoded = 128 << 20
+
+// Animation is a sequence of frames ready to be drawn to the screen
+type Animation struct {
+	Frames []*image.RGBA
+	Delays []time.Duration
+	// Plays is how many times the animation runs, 0 loops forever
+	Plays int
+}
+
+// disposal is what happens to a frame's area before the next frame is drawn
+type disposal int
+
+const (
+	disposeNone       disposal = iota // leave the frame on the canvas
+	disposeBackground                 // clear the frame's area
+	disposePrevious                   // restore the canvas from before the frame
+)
+
+// animationFrame is a frame as stored in a file, before compositing
+type animationFrame struct {
+	img     image.Image
+	rect    image.Rectangle // where the frame goes on the canvas
+	delay   time.Duration
+	blend   bool // draw over the canvas rather than replacing the area
+	dispose disposal
+}
+
+// frameDelay plays very short delays at 100ms, as browsers do. Many files
+// rely on it.
+func frameDelay(d time.Duration) time.Duration {
+	if d <= 10*time.Millisecond {
+		return 100 * time.Millisecond
+	}
+	return d
+}
+
+// checkAnimationSize reports a canvas or frame too large to decode. Sizes are
+// int64 so those read from a file cannot wrap around.
+func checkAnimationSize(what string, w, h int64) error {
+	if w > MaxAnimationSide || h > MaxAnimationSide || w*h > MaxAnimationPixels {
+		return fmt.Errorf("%s of %dx%d is too large, at most %dx%d and %d pixels are supported", what, w, h, MaxAnimationSide, MaxAnimationSide, MaxAnimationPixels)
+	}
+	return nil
+}
+
+// animationBudget keeps an animation within MaxAnimationFrames,
+// MaxAnimationMemory and MaxAnimationDecoded. Decoders count the frames in a
+// file before decoding any of them, and take each frame from the budget
+// before decoding it.
+type animationBudget struct {
+	// screen is the size of a frame laid out for the screen
+	screen  int64
+	decoded int64
+}
+
+func newAnimationBudget(screen image.Point) *animationBudget {
+	return &animationBudget{screen: int64(screen.X) * int64(screen.Y) * 4}
+}
+
+// frames checks an animation of n frames fits once laid out for the screen
+func (b *animationBudget) frames(n int) error {
+	if n > MaxAnimationFrames {
+		return fmt.Errorf("%d frames, at most %d are supported", n, MaxAnimationFrames)
+	}
+	if need := int64(n) * b.screen; need > MaxAnimationMemory {
+		return fmt.Errorf("%d frames take up %dMB on the screen, at most %dMB is supported", n, need>>20, MaxAnimationMemory>>20)
+	}
+	return nil
+}
+
+// decode takes a frame of w by h pixels from the budget. Sizes must have been
+// through checkAnimationSize.
+func (b *animationBudget) decode(w, h, bytesPerPixel int64) error {
+	b.decoded += w * h * bytesPerPixel
+	if b.decoded > MaxAnimationDecoded {
+		return fmt.Errorf("the frames take up more than the %dMB supported once decoded", MaxAnimationDecoded>>20)
+	}
+	return nil
+}
+
+// composite renders each frame onto a canvas of the given size, applying
+// blending and disposal, and lays the result out for the screen
+func composite(size image.Point, frames []animationFrame, plays int, layout Layout, screen image.Point) *Animation {
+	canvas := image.NewRGBA(image.Rectangle{Max: size})
+	previous := image.NewRGBA(canvas.Rect)
+	anim := &Animation{Plays: plays}
+	for _, f := range frames {
+		if f.dispose == disposePrevious {
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		op := draw.Src
+		if f.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, f.rect, f.img, f.img.Bounds().Min, op)
+
+		anim.Frames = append(anim.Frames, layout.Render(canvas, screen))
+		anim.Delays = append(anim.Delays, frameDelay(f.delay))
+
+		switch f.dispose {
+		case disposeBackground:
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		case disposePrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return anim
+}
+
+// gifFrameSizes reads the size of each frame from the image descriptors of a
+// GIF without decoding any. It stops at anything it does not understand,
+// which gif.DecodeAll then reports.
+func gifFrameSizes(data []byte) []image.Point {
+	var sizes []image.Point
+	if len(data) < 13 {
+		return nil
+	}
+	o := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		o += 3 << (flags&0x07 + 1)
+	}
+	// skipBlocks skips data sub-blocks up to the empty one ending them
+	skipBlocks := func() {
+		for o < len(data) {
+			n := int(data[o])
+			o++
+			if n == 0 {
+				return
+			}
+			o += n
+		}
+	}
+	for o < len(data) {
+		switch data[o] {
+		case 0x21: // extension
+			o += 2
+			skipBlocks()
+		case 0x2c: // image descriptor
+			if o+10 > len(data) {
+				return sizes
+			}
+			w := int(binary.LittleEndian.Uint16(data[o+5:]))
+			h := int(binary.LittleEndian.Uint16(data[o+7:]))
+			sizes = append(sizes, image.Pt(w, h))
+			flags := data[o+9]
+			o += 10
+			if flags&0x80 != 0 {
+				o += 3 << (flags&0x07 + 1)
+			}
+			// the LZW minimum code size comes before the image data
+			o++
+			skipBlocks()
+		default:
+			return sizes
+		}
+	}
+	return sizes
+}
+
+// decodeGIF decodes every frame of a GIF
+func decodeGIF(data []byte, budget *animationBudget) (image.Point, []animationFrame, int, error) {
+	// every frame is allocated as it is decoded, and none may be larger
+	// than the logical screen
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	if err := checkAnimationSize("canvas", int64(config.Width), int64(config.Height)); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	// gif.DecodeAll decodes every frame at once, one byte a pixel
+	sizes := gifFrameSizes(data)
+	if err := budget.frames(len(sizes)); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	for _, size := range sizes {
+		if err := checkAnimationSize("frame", int64(size.X), int64(size.Y)); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		if err := budget.decode(int64(size.X), int64(size.Y), 1); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	if err := budget.frames(len(g.Image)); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	size := image.Pt(g.Config.Width, g.Config.Height)
+	frames := make([]animationFrame, len(g.Image))
+	for i, img := range g.Image {
+		f := animationFrame{img: img, rect: img.Bounds(), blend: true}
+		if i < len(g.Delay) {
+			f.delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				f.dispose = disposeBackground
+			case gif.DisposalPrevious:
+				f.dispose = disposePrevious
+			}
+		}
+		frames[i] = f
+	}
+
+	// LoopCount is 0 to loop forever, -1 to play once, or n to play n+1 times
+	plays := 0
+	if g.LoopCount < 0 {
+		plays = 1
+	} else if g.LoopCount > 0 {
+		plays = g.LoopCount + 1
+	}
+	return size, frames, plays, nil
+}
+
+// decodeAnimation detects the format of data and decodes it. Still images are
+// returned as a single frame.
+func decodeAnimation(data []byte, layout Layout, screen image.Point) (*Animation, error) {
+	var (
+		size   image.Point
+		frames []animationFrame
+		plays  int
+		err    error
+	)
+	budget := newAnimationBudget(screen)
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		size, frames, plays, err = decodeGIF(data, budget)
+	case bytes.HasPrefix(data, pngSignature):
+		size, frames, plays, err = decodeAPNG(data, budget)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		size, frames, plays, err = decodeWebP(data, budget)
+	default:
+		return nil, fmt.Errorf("unsupported format, send a GIF, APNG or WebP")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames")
+	}
+	if size.X <= 0 || size.Y <= 0 {
+		// fall back to the area covered by the frames
+		var bounds image.Rectangle
+		for _, f := range frames {
+			bounds = bounds.Union(f.rect)
+		}
+		size = bounds.Max
+	}
+	if err := checkAnimationSize("canvas", int64(size.X), int64(size.Y)); err != nil {
+		return nil, err
+	}
+	return composite(size, frames, plays, layout, screen), nil
+}
+
+// player plays one animation at a time in the background
+type player struct {
+	mu    sync.Mutex
+	layer string
+	stop  context.CancelFunc
+	done  chan struct{}
+}
+
+// Play starts anim on layer, replacing whatever was playing. The context
+// passed to drawFrame is cancelled when the animation is stopped.
+func (p *player) Play(layer string, anim *Animation, drawFrame func(context.Context, image.Image) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+
+	ctx, stop := context.WithCancel(withSource(context.Background(), SourceAnimation))
+	done := make(chan struct{})
+	p.layer, p.stop, p.done = layer, stop, done
+	go func() {
+		defer close(done)
+		for play := 0; anim.Plays == 0 || play < anim.Plays; play++ {
+			// schedule from the start of each frame so drawing time does
+			// not slow the animation down
+			next := time.Now()
+			for i, frame := range anim.Frames {
+				if err := drawFrame(ctx, frame); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					fmt.Fprintf(os.Stderr, "Stopping animation: %v\n", err)
+					return
+				}
+				next = next.Add(anim.Delays[i])
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the animation and waits for the frame being drawn
+func (p *player) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+}
+
+// StopOn stops the animation if it plays on layer
+func (p *player) StopOn(layer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.layer == layer {
+		p.stopLocked()
+	}
+}
+
+func (p *player) stopLocked() {
+	if p.stop == nil {
+		return
+	}
+	p.stop()
+	<-p.done
+	p.layer, p.stop, p.done = "", nil, nil
+}
+
+// Playing reports whether an animation is playing, and on which layer
+func (p *player) Playing() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == nil {
+		return "", false
+	}
+	select {
+	case <-p.done:
+		return "", false
+	default:
+		return p.layer, true
+	}
+}
+
+// AnimationResponse is the response of /animation
+type AnimationResponse struct {
+	Playing bool   `json:"playing"`
+	Layer   string `json:"layer,omitempty"`
+	Frames  int    `json:"frames,omitempty"`
+	Plays   int    `json:"plays,omitempty"`
+}
+
+// Animation plays a GIF, APNG or WebP posted to it in the background until it
+// finishes, something else is drawn to its layer or the layer is removed.
+// ?plays= overrides the file's loop count (0 loops forever), and the ?fit=
+// family of /image parameters applies to every frame. It plays on the app
+// layer unless ?layer= says otherwise. DELETE stops the animation.
+func (b *PiboxFrameBuffer) Animation(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		layer, playing := b.player.Playing()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AnimationResponse{Playing: playing, Layer: layer})
+		return
+	case http.MethodDelete:
+		b.player.Stop()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AnimationResponse{Playing: false})
+		return
+	case http.MethodPost, http.MethodPut:
+	default:
+		writeError(w, methodNotAllowed(w, "GET, POST, PUT, DELETE"))
+		return
+	}
+
+	if _, err := readFrameBuffer(); err != nil {
+		writeError(w, err)
+		return
+	}
+	query := req.URL.Query()
+	layout, err := parseLayout(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	priority, err := queryPriority(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	layer, err := queryLayer(query, LayerApp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	opts, err := parseLayerOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	plays, err := queryInt(query, "plays", -1)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxAnimationSize))
+	if err != nil {
+		writeError(w, badRequest("invalid_image", "Could not read animation", err))
+		return
+	}
+	screen := image.Pt(b.config.screenSize, b.config.screenSize)
+	anim, err := decodeAnimation(data, layout, screen)
+	if err != nil {
+		writeError(w, badRequest("invalid_image", "Could not decode animation", err))
+		return
+	}
+	if plays >= 0 {
+		anim.Plays = plays
+	}
+
+	b.player.StopOn(layer)
+	if _, err := b.layers.set(layer, opts, nil); err != nil {
+		writeError(w, err)
+		return
+	}
+	b.player.Play(layer, anim, func(ctx context.Context, frame image.Image) error {
+		return b.redrawChange(ctx, priority, func() error {
+			// frames never bring back a layer that was removed or timed out
+			painted := b.layers.paint(layer, func(dst *image.RGBA) {
+				draw.Draw(dst, dst.Rect, frame, frame.Bounds().Min, draw.Src)
+			})
+			if !painted {
+				return fmt.Errorf("layer %s was removed", layer)
+			}
+			return nil
+		})
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(AnimationResponse{
+		Playing: true,
+		Layer:   layer,
+		Frames:  len(anim.Frames),
+		Plays:   anim.Plays,
+	})
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"time"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var errInvalidAPNG = errors.New("invalid APNG")
+
+// apngFrame is a frame control (fcTL) chunk and the image data that follows
+type apngFrame struct {
+	control []byte
+	data    []byte
+}
+
+// decodeAPNG decodes an animated PNG. image/png only reads the default
+// image, so each frame is rewritten as a standalone PNG: the IHDR with the
+// frame's size, the chunks shared by all frames such as PLTE and tRNS, and
+// the frame's data as IDAT. A PNG without an acTL chunk is a single frame.
+func decodeAPNG(data []byte, budget *animationBudget) (image.Point, []animationFrame, int, error) {
+	var (
+		ihdr     []byte
+		shared   [][]byte
+		frames   []*apngFrame
+		current  *apngFrame
+		animated bool
+		plays    int
+		seenIDAT bool
+	)
+	for o := len(pngSignature); o+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[o:]))
+		if n < 0 || o+12+n > len(data) {
+			return image.Point{}, nil, 0, errInvalidAPNG
+		}
+		typ := string(data[o+4 : o+8])
+		chunk := data[o : o+12+n]
+		payload := data[o+8 : o+8+n]
+		o += 12 + n
+
+		switch typ {
+		case "IHDR":
+			if n != 13 {
+				return image.Point{}, nil, 0, errInvalidAPNG
+			}
+			ihdr = payload
+		case "acTL":
+			if n != 8 {
+				return image.Point{}, nil, 0, errInvalidAPNG
+			}
+			animated = true
+			plays = int(binary.BigEndian.Uint32(payload[4:]))
+		case "fcTL":
+			if n != 26 {
+				return image.Point{}, nil, 0, errInvalidAPNG
+			}
+			current = &apngFrame{control: payload}
+			frames = append(frames, current)
+		case "IDAT":
+			seenIDAT = true
+			// the default image is only part of the animation when a
+			// frame control chunk comes before it
+			if current != nil {
+				current.data = append(current.data, payload...)
+			}
+		case "fdAT":
+			if current == nil || n < 4 {
+				return image.Point{}, nil, 0, errInvalidAPNG
+			}
+			current.data = append(current.data, payload[4:]...)
+		case "IEND":
+		default:
+			if !seenIDAT {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+	if ihdr == nil {
+		return image.Point{}, nil, 0, errInvalidAPNG
+	}
+	width, height := binary.BigEndian.Uint32(ihdr[0:]), binary.BigEndian.Uint32(ihdr[4:])
+	if err := checkAnimationSize("canvas", int64(width), int64(height)); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	size := image.Pt(int(width), int(height))
+	// image/png decodes 16 bit images to 8 bytes a pixel
+	bytesPerPixel := int64(4)
+	if ihdr[8] == 16 {
+		bytesPerPixel = 8
+	}
+
+	if !animated {
+		if err := budget.frames(1); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		if err := budget.decode(int64(width), int64(height), bytesPerPixel); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		return size, []animationFrame{{img: img, rect: img.Bounds()}}, 1, nil
+	}
+
+	if err := budget.frames(len(frames)); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	result := make([]animationFrame, 0, len(frames))
+	for i, f := range frames {
+		c := f.control
+		w := binary.BigEndian.Uint32(c[4:])
+		h := binary.BigEndian.Uint32(c[8:])
+		x := binary.BigEndian.Uint32(c[12:])
+		y := binary.BigEndian.Uint32(c[16:])
+		if err := checkAnimationSize("frame", int64(w), int64(h)); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		// anything past the canvas is cut off, but offsets this large would
+		// not fit in an int
+		if x > MaxAnimationSide || y > MaxAnimationSide {
+			return image.Point{}, nil, 0, errInvalidAPNG
+		}
+		if err := budget.decode(int64(w), int64(h), bytesPerPixel); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		num := time.Duration(binary.BigEndian.Uint16(c[20:]))
+		den := time.Duration(binary.BigEndian.Uint16(c[22:]))
+		if den == 0 {
+			den = 100
+		}
+
+		var buf bytes.Buffer
+		buf.Write(pngSignature)
+		header := append([]byte{}, ihdr...)
+		binary.BigEndian.PutUint32(header[0:], w)
+		binary.BigEndian.PutUint32(header[4:], h)
+		writePNGChunk(&buf, "IHDR", header)
+		for _, chunk := range shared {
+			buf.Write(chunk)
+		}
+		writePNGChunk(&buf, "IDAT", f.data)
+		writePNGChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			return image.Point{}, nil, 0, err
+		}
+
+		frame := animationFrame{
+			img:   img,
+			rect:  image.Rect(int(x), int(y), int(x+w), int(y+h)),
+			delay: num * time.Second / den,
+			blend: c[25] == 1,
+		}
+		switch c[24] {
+		case 1:
+			frame.dispose = disposeBackground
+		case 2:
+			// the first frame has nothing to go back to
+			if i == 0 {
+				frame.dispose = disposeBackground
+			} else {
+				frame.dispose = disposePrevious
+			}
+		}
+		result = append(result, frame)
+	}
+	return size, result, plays, nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	buf.Write(n[:])
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	buf.Write(n[:])
+}
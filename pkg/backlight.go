@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/backlight"
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// DefaultBacklightFade is how long the backlight takes to change brightness
+// unless a request says otherwise
+const DefaultBacklightFade = 300 * time.Millisecond
+
+// MaxBacklightFade is the longest fade a request may ask for
+const MaxBacklightFade = time.Minute
+
+// BacklightState is the response of /backlight
+type BacklightState struct {
+	// Brightness is what the backlight is at or fading to, from 0 to 100
+	Brightness int `json:"brightness"`
+	// Level is the brightness right now, part of the way through a fade
+	Level  int  `json:"level"`
+	Fading bool `json:"fading"`
+}
+
+func backlightState(bl *backlight.Backlight) BacklightState {
+	return BacklightState{
+		Brightness: bl.Target(),
+		Level:      bl.Level(),
+		Fading:     bl.Fading(),
+	}
+}
+
+// openBacklight returns the display's backlight. It is driven by a GPIO pin
+// of its own and may be read at any time, but changes go through
+// setBrightness.
+func openBacklight() (*backlight.Backlight, error) {
+	fb, err := readFrameBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return fb.Backlight(), nil
+}
+
+// setBrightness fades the backlight to level over fade. It runs on the render
+// queue, like Sleep and Wake, so it can not race them over the brightness the
+// display wakes up to.
+func (b *PiboxFrameBuffer) setBrightness(ctx context.Context, level int, fade time.Duration) error {
+	return b.queue.Draw(ctx, PriorityNormal, false, func(fb *display.Display) error {
+		fb.SetBrightness(level, fade)
+		return nil
+	})
+}
+
+// StartBacklight fades the backlight from fully on, where the panel starts,
+// to the configured brightness
+func (b *PiboxFrameBuffer) StartBacklight() error {
+	return b.setBrightness(context.Background(), b.config.backlight, b.config.backlightFade)
+}
+
+// Backlight reports the brightness of the backlight on GET, and changes it
+// to ?brightness= on PUT, fading over ?fade= or the configured fade
+func (b *PiboxFrameBuffer) Backlight(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost:
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, PUT, POST"))
+		return
+	}
+	bl, err := openBacklight()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if req.Method == http.MethodPut || req.Method == http.MethodPost {
+		query := req.URL.Query()
+		v := query.Get("brightness")
+		if v == "" {
+			writeError(w, badRequest("missing_parameter", "Pass ?brightness= from 0 to 100", nil))
+			return
+		}
+		brightness, err := strconv.Atoi(v)
+		if err != nil || brightness < 0 || brightness > backlight.Max {
+			writeError(w, badRequest("invalid_parameter", fmt.Sprintf("brightness must be a number from 0 to %d", backlight.Max), err))
+			return
+		}
+		fade := b.config.backlightFade
+		if v := query.Get("fade"); v != "" {
+			fade, err = time.ParseDuration(v)
+			if err != nil || fade < 0 || fade > MaxBacklightFade {
+				writeError(w, badRequest("invalid_parameter", fmt.Sprintf("fade must be a duration like 500ms, up to %v", MaxBacklightFade), err))
+				return
+			}
+		}
+		if b.idle.isAsleep() {
+			// a backlight over a sleeping panel lights up nothing
+			if err := b.redraw(req.Context(), PriorityNormal); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		if err := b.setBrightness(req.Context(), brightness, fade); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backlightState(bl))
+}
@@ -0,0 +1,610 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LayerCarousel is the layer the carousel shows its pages on, above the
+// background and below the app layer
+const LayerCarousel = "carousel"
+
+// MaxCarouselPages is how many pages the carousel may hold
+const MaxCarouselPages = 32
+
+// DefaultCarouselDwell is how long a page is shown unless it says otherwise
+const DefaultCarouselDwell = 10 * time.Second
+
+// Shortest and longest time a page may be shown for
+const (
+	MinCarouselDwell = time.Second
+	MaxCarouselDwell = 24 * time.Hour
+)
+
+// Types of carousel pages
+const (
+	PageImage = "image"
+	PageStats = "stats"
+	PageQR    = "qr"
+	PageText  = "text"
+)
+
+// Transitions into a carousel page
+const (
+	TransitionNone  = "none"
+	TransitionSlide = "slide"
+	TransitionFade  = "fade"
+)
+
+// transitionFrames frames are drawn over transitionDuration when changing
+// pages with a transition
+const (
+	transitionFrames   = 12
+	transitionDuration = 480 * time.Millisecond
+)
+
+// CarouselPage is a page the carousel cycles through, as listed by /carousel
+type CarouselPage struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Dwell is how long the page is shown before the next one
+	Dwell string `json:"dwell"`
+	// Order sorts the pages, pages of the same order are shown in the order
+	// they were added
+	Order      int    `json:"order"`
+	Transition string `json:"transition"`
+	// Content is the text of text and qr pages
+	Content string `json:"content,omitempty"`
+}
+
+// carouselPage is a registered page with what it draws
+type carouselPage struct {
+	CarouselPage
+	dwell time.Duration
+	seq   uint64
+	// frame is drawn for every type but stats, which is rendered fresh
+	frame *image.RGBA
+}
+
+func carouselPageNotFound(id string) *Error {
+	return newError(http.StatusNotFound, "page_not_found", fmt.Sprintf("There is no carousel page %q", id), nil)
+}
+
+// carousel holds the pages and which one is on the screen. runCarousel
+// shows them.
+type carousel struct {
+	mu      sync.Mutex
+	pages   []*carouselPage
+	seq     uint64
+	current string
+	pinned  string
+	// skip moves on to the next page without waiting for the dwell time
+	skip bool
+
+	// wake tells runCarousel the pages changed
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func (c *carousel) init() {
+	c.wake = make(chan struct{}, 1)
+	c.ctx, c.cancel = context.WithCancel(withSource(context.Background(), SourceCarousel))
+	c.stopped = make(chan struct{})
+}
+
+func (c *carousel) wakeLocked() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *carousel) indexLocked(id string) int {
+	for i, p := range c.pages {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add registers a page, replacing any page with the same id. A page without
+// an id is given one.
+func (c *carousel) Add(page *carouselPage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page.ID == "" {
+		page.ID = c.nextIDLocked()
+	}
+	if i := c.indexLocked(page.ID); i >= 0 {
+		page.seq = c.pages[i].seq
+		c.pages = append(c.pages[:i], c.pages[i+1:]...)
+	} else {
+		if len(c.pages) >= MaxCarouselPages {
+			return newError(http.StatusConflict, "carousel_full", fmt.Sprintf("The carousel already holds %d pages, remove one first", MaxCarouselPages), nil)
+		}
+		c.seq++
+		page.seq = c.seq
+	}
+	c.pages = append(c.pages, page)
+	sort.Slice(c.pages, func(i, j int) bool {
+		if c.pages[i].Order != c.pages[j].Order {
+			return c.pages[i].Order < c.pages[j].Order
+		}
+		return c.pages[i].seq < c.pages[j].seq
+	})
+	c.wakeLocked()
+	return nil
+}
+
+// nextIDLocked returns an id for a page added without one
+func (c *carousel) nextIDLocked() string {
+	for n := c.seq + 1; ; n++ {
+		id := fmt.Sprintf("page-%d", n)
+		if c.indexLocked(id) < 0 {
+			return id
+		}
+	}
+}
+
+// Remove drops a page, reporting whether it existed
+func (c *carousel) Remove(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.indexLocked(id)
+	if i < 0 {
+		return false
+	}
+	c.pages = append(c.pages[:i], c.pages[i+1:]...)
+	if c.pinned == id {
+		c.pinned = ""
+	}
+	c.wakeLocked()
+	return true
+}
+
+// Clear drops all pages
+func (c *carousel) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = nil
+	c.pinned = ""
+	c.wakeLocked()
+}
+
+// Pin shows the page id until it is unpinned
+func (c *carousel) Pin(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.indexLocked(id) < 0 {
+		return carouselPageNotFound(id)
+	}
+	c.pinned = id
+	c.wakeLocked()
+	return nil
+}
+
+// Unpin carries on cycling from the pinned page
+func (c *carousel) Unpin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned = ""
+	c.wakeLocked()
+}
+
+// Skip moves on to the next page straight away
+func (c *carousel) Skip() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned != "" {
+		return newError(http.StatusConflict, "carousel_pinned", fmt.Sprintf("Page %q is pinned, unpin it to skip", c.pinned), nil)
+	}
+	if len(c.pages) == 0 {
+		return newError(http.StatusConflict, "carousel_empty", "The carousel has no pages", nil)
+	}
+	c.skip = true
+	c.wakeLocked()
+	return nil
+}
+
+// pick returns the page to show: the pinned page, else the current one or,
+// if advance is set, the one after it. It returns nil when there are no
+// pages, and false once the carousel is closed.
+func (c *carousel) pick(advance bool) (*carouselPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return nil, false
+	}
+	advance = advance || c.skip
+	c.skip = false
+	if len(c.pages) == 0 {
+		c.current = ""
+		return nil, true
+	}
+	var page *carouselPage
+	if i := c.indexLocked(c.pinned); i >= 0 {
+		page = c.pages[i]
+	} else {
+		switch i := c.indexLocked(c.current); {
+		case i < 0:
+			page = c.pages[0]
+		case advance:
+			page = c.pages[(i+1)%len(c.pages)]
+		default:
+			page = c.pages[i]
+		}
+	}
+	c.current = page.ID
+	return page, true
+}
+
+// List returns the pages in the order they are shown, the page on the
+// screen and the pinned page
+func (c *carousel) List() CarouselResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pages := make([]CarouselPage, len(c.pages))
+	for i, p := range c.pages {
+		pages[i] = p.CarouselPage
+	}
+	return CarouselResponse{Pages: pages, Current: c.current, Pinned: c.pinned}
+}
+
+// Get returns the page id
+func (c *carousel) Get(id string) (CarouselPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.indexLocked(id)
+	if i < 0 {
+		return CarouselPage{}, false
+	}
+	return c.pages[i].CarouselPage, true
+}
+
+// Close stops showing pages
+func (c *carousel) Close() {
+	c.cancel()
+	<-c.stopped
+}
+
+// runCarousel shows the pages until the carousel is closed
+func (b *PiboxFrameBuffer) runCarousel() {
+	c := &b.carousel
+	defer close(c.stopped)
+	var shown *carouselPage
+	var frame *image.RGBA
+	var deadline time.Time
+	advance, stale := false, false
+	for {
+		page, ok := c.pick(advance)
+		if !ok {
+			return
+		}
+		if page == nil {
+			if shown != nil {
+				shown, frame = nil, nil
+				if b.layers.remove(LayerCarousel) {
+					if err := b.redraw(c.ctx, PriorityLow); err != nil && c.ctx.Err() == nil {
+						fmt.Fprintf(os.Stderr, "Could not clear the carousel: %v\n", err)
+					}
+				}
+			}
+			advance = false
+			select {
+			case <-c.wake:
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		changed := shown == nil || page.ID != shown.ID
+		if changed || advance {
+			deadline = time.Now().Add(page.dwell)
+		}
+		if page != shown || stale {
+			next, err := b.renderPage(page)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not render carousel page %s: %v\n", page.ID, err)
+			} else {
+				if changed && frame != nil {
+					b.transition(frame, next, page.Transition)
+				}
+				if err := b.showCarouselFrame(next); err != nil && c.ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "Could not show carousel page %s: %v\n", page.ID, err)
+				}
+				frame = next
+			}
+		}
+		shown = page
+		advance, stale = false, false
+
+		// the stats page is kept up to date while it is shown
+		var refresh *time.Timer
+		var refreshed <-chan time.Time
+		if page.Type == PageStats {
+			refresh = time.NewTimer(b.config.statsInterval)
+			refreshed = refresh.C
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-timer.C:
+			advance = true
+		case <-c.wake:
+		case <-refreshed:
+			stale = true
+		case <-c.ctx.Done():
+		}
+		timer.Stop()
+		if refresh != nil {
+			refresh.Stop()
+		}
+
+		if (advance || stale) && b.quiet.paused() {
+			// quiet hours hold the page on screen until they end
+			advance, stale = false, false
+			select {
+			case <-c.wake:
+			case <-c.ctx.Done():
+			}
+		}
+	}
+}
+
+// renderPage returns the frame of a page
+func (b *PiboxFrameBuffer) renderPage(page *carouselPage) (*image.RGBA, error) {
+	if page.Type != PageStats {
+		return page.frame, nil
+	}
+	img, err := b.RenderStats()
+	if err != nil {
+		return nil, err
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, b.config.screenSize, b.config.screenSize))
+	draw.Draw(frame, frame.Rect, img, img.Bounds().Min, draw.Src)
+	return frame, nil
+}
+
+func (b *PiboxFrameBuffer) showCarouselFrame(frame *image.RGBA) error {
+	_, err := b.drawLayer(b.carousel.ctx, PriorityLow, LayerCarousel, layerOptions{}, func(layer *image.RGBA) {
+		draw.Draw(layer, layer.Rect, frame, image.Point{}, draw.Src)
+	})
+	return err
+}
+
+// transition draws the frames between two pages, leaving the last one to
+// the caller
+func (b *PiboxFrameBuffer) transition(from, to *image.RGBA, kind string) {
+	if kind != TransitionSlide && kind != TransitionFade {
+		return
+	}
+	step := image.NewRGBA(from.Rect)
+	width := from.Rect.Dx()
+	start := time.Now()
+	// one timer paces every frame, stopped and drained until it is needed
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	for i := 1; i < transitionFrames; i++ {
+		t := float64(i) / transitionFrames
+		switch kind {
+		case TransitionSlide:
+			// the new page pushes the old one out to the left
+			offset := int(t * float64(width))
+			draw.Draw(step, step.Rect, from, image.Pt(offset, 0), draw.Src)
+			draw.Draw(step, image.Rect(width-offset, 0, width, step.Rect.Dy()), to, image.Point{}, draw.Src)
+		case TransitionFade:
+			draw.Draw(step, step.Rect, from, image.Point{}, draw.Src)
+			mask := &image.Uniform{color.Alpha{uint8(t*255 + 0.5)}}
+			draw.DrawMask(step, step.Rect, to, image.Point{}, mask, image.Point{}, draw.Over)
+		}
+		if err := b.showCarouselFrame(step); err != nil {
+			return
+		}
+		// keep to the frame rate, but never wait to catch up
+		if wait := time.Until(start.Add(transitionDuration * time.Duration(i) / transitionFrames)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-b.carousel.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// newCarouselPage builds the page described by the query of req, reading
+// the image of image pages from its body. Pages keep only the frame they
+// show, a screen's worth of pixels.
+func (b *PiboxFrameBuffer) newCarouselPage(w http.ResponseWriter, req *http.Request) (*carouselPage, error) {
+	query := req.URL.Query()
+	page := &carouselPage{
+		CarouselPage: CarouselPage{
+			ID:         query.Get("id"),
+			Type:       query.Get("type"),
+			Dwell:      query.Get("dwell"),
+			Transition: query.Get("transition"),
+			Content:    query.Get("content"),
+		},
+		dwell: DefaultCarouselDwell,
+	}
+	// pages without an id are given one when they are added
+	if page.ID != "" && (!layerName.MatchString(page.ID) || page.ID == "pin" || page.ID == "skip") {
+		return nil, badRequest("invalid_page_id", fmt.Sprintf("Invalid page id %q, use up to 32 lower case letters, digits, - and _", page.ID), nil)
+	}
+	if page.Dwell != "" {
+		dwell, err := time.ParseDuration(page.Dwell)
+		if err != nil || dwell < MinCarouselDwell || dwell > MaxCarouselDwell {
+			return nil, badRequest("invalid_parameter", fmt.Sprintf("dwell must be a duration between %v and %v", MinCarouselDwell, MaxCarouselDwell), err)
+		}
+		page.dwell = dwell
+	}
+	page.Dwell = page.dwell.String()
+	order, err := queryInt(query, "order", 0)
+	if err != nil {
+		return nil, err
+	}
+	page.Order = order
+	switch page.Transition {
+	case "":
+		page.Transition = TransitionNone
+	case TransitionNone, TransitionSlide, TransitionFade:
+	default:
+		return nil, badRequest("invalid_parameter", "transition must be none, slide or fade", nil)
+	}
+
+	size := image.Pt(b.config.screenSize, b.config.screenSize)
+	switch page.Type {
+	case PageImage:
+		layout, err := parseLayout(query)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxImageSize))
+		if err != nil {
+			return nil, badRequest("invalid_image", "Could not read image", err)
+		}
+		img, err := decodeImage(data, MaxAnimationSide)
+		if err != nil {
+			return nil, badRequest("invalid_image", "Could not decode image, send a PNG, JPEG or GIF body", err)
+		}
+		page.frame = layout.Render(img, size)
+	case PageStats:
+		page.Content = ""
+	case PageQR:
+		opts, err := parseQROptions(query)
+		if err != nil {
+			return nil, err
+		}
+		if page.frame, err = opts.render(b.config.screenSize); err != nil {
+			return nil, err
+		}
+	case PageText:
+		if page.Content == "" {
+			return nil, badRequest("missing_parameter", "Pass ?content= with the text of the page", nil)
+		}
+		frame, err := b.renderText(page.Content, query, "ffffff", "000000")
+		if err != nil {
+			return nil, err
+		}
+		page.frame = frame
+	case "":
+		return nil, badRequest("missing_parameter", "Pass ?type= with image, stats, qr or text", nil)
+	default:
+		return nil, badRequest("invalid_parameter", fmt.Sprintf("Unknown page type %q, use image, stats, qr or text", page.Type), nil)
+	}
+	return page, nil
+}
+
+// CarouselResponse is the response of a GET of /carousel
+type CarouselResponse struct {
+	Pages []CarouselPage `json:"pages"`
+	// Current is the page on the screen
+	Current string `json:"current,omitempty"`
+	Pinned  string `json:"pinned,omitempty"`
+}
+
+// Carousel manages the pages the carousel cycles through. GET lists them,
+// POST adds the page described by the query, replacing any page with the
+// same id, and DELETE removes them all.
+func (b *PiboxFrameBuffer) Carousel(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.carousel.List())
+	case http.MethodPost:
+		page, err := b.newCarouselPage(w, req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := b.carousel.Add(page); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(page.CarouselPage)
+	case http.MethodDelete:
+		b.carousel.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, POST, DELETE"))
+	}
+}
+
+// CarouselPath handles the paths under /carousel/. POST /carousel/skip moves
+// on to the next page, POST /carousel/pin?id= holds a page on the screen and
+// DELETE /carousel/pin lets the carousel carry on. GET /carousel/{id}
+// returns a page and DELETE removes it.
+func (b *PiboxFrameBuffer) CarouselPath(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/carousel/")
+	switch name {
+	case "skip":
+		if req.Method != http.MethodPost {
+			writeError(w, methodNotAllowed(w, "POST"))
+			return
+		}
+		if err := b.carousel.Skip(); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "pin":
+		switch req.Method {
+		case http.MethodPost, http.MethodPut:
+			id := req.URL.Query().Get("id")
+			if id == "" {
+				writeError(w, badRequest("missing_parameter", "Pass ?id= with the page to pin", nil))
+				return
+			}
+			if err := b.carousel.Pin(id); err != nil {
+				writeError(w, err)
+				return
+			}
+		case http.MethodDelete:
+			b.carousel.Unpin()
+		default:
+			writeError(w, methodNotAllowed(w, "POST, PUT, DELETE"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		page, ok := b.carousel.Get(name)
+		if !ok {
+			writeError(w, carouselPageNotFound(name))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	case http.MethodDelete:
+		if !b.carousel.Remove(name) {
+			writeError(w, carouselPageNotFound(name))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, DELETE"))
+	}
+}
@@ -1,6 +1,158 @@
 package pkg
 
+import "time"
+
 type Config struct {
 	diskMountPrefix string
-	screenSize      int    // Dimension of the screen (assuming it's square)
+	screenSize      int // Dimension of the screen (assuming it's square)
+
+	// shutdownFrame is drawn when the server shuts down: "none", "splash",
+	// a hex colour or the path to an image file
+	shutdownFrame string
+	// shutdownBacklight leaves the backlight on after shutting down
+	shutdownBacklight bool
+
+	// backlight is the brightness of the backlight from 0 to 100, and
+	// backlightFade how long it takes to change
+	backlight     int
+	backlightFade time.Duration
+
+	// queueSize is how many draws may wait for the display at once
+	queueSize int
+
+	// statsWidgets are shown on the stats screen from the top down
+	statsWidgets    []string
+	statsInterval   time.Duration
+	statsThresholds map[string]Threshold
+	// statsInterfaces are the network interfaces shown, all of them if empty
+	statsInterfaces []string
+
+	// fontsDir is searched for TrueType fonts on startup
+	fontsDir string
+	// fontFamily is the family text is drawn in unless a request names one
+	fontFamily string
+
+	// idleTimeout is how long the display stays on after the last draw, 0
+	// to keep it on
+	idleTimeout time.Duration
+
+	// diskReportTTL is how long the report of /disk-stats is reused
+	diskReportTTL time.Duration
+
+	// quietHours is when the display is dimmed to quietBrightness, or
+	// blanked if that is 0. nil has no quiet hours.
+	quietHours      *QuietSchedule
+	quietBrightness int
+}
+
+const DefaultShutdownFrame = "0000ff"
+
+// Option changes the configuration of a PiboxFrameBuffer
+type Option func(*Config)
+
+// WithShutdownFrame sets what is drawn when the server shuts down
+func WithShutdownFrame(frame string) Option {
+	return func(c *Config) {
+		c.shutdownFrame = frame
+	}
+}
+
+// WithShutdownBacklight sets whether the backlight stays on after shutdown
+func WithShutdownBacklight(on bool) Option {
+	return func(c *Config) {
+		c.shutdownBacklight = on
+	}
+}
+
+// WithBacklight sets the brightness of the backlight after startup, from 0 to
+// 100
+func WithBacklight(brightness int) Option {
+	return func(c *Config) {
+		c.backlight = brightness
+	}
+}
+
+// WithBacklightFade sets how long the backlight takes to change brightness
+func WithBacklightFade(fade time.Duration) Option {
+	return func(c *Config) {
+		c.backlightFade = fade
+	}
+}
+
+// WithQueueSize sets how many draws may wait for the display before requests
+// are turned away with a 429
+func WithQueueSize(size int) Option {
+	return func(c *Config) {
+		c.queueSize = size
+	}
+}
+
+// WithStatsWidgets sets the widgets on the stats screen, from the top down
+func WithStatsWidgets(widgets []string) Option {
+	return func(c *Config) {
+		c.statsWidgets = widgets
+	}
+}
+
+// WithStatsInterval sets how often the stats screen is redrawn
+func WithStatsInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.statsInterval = interval
+	}
+}
+
+// WithStatsThresholds overrides the default thresholds of some metrics
+func WithStatsThresholds(thresholds map[string]Threshold) Option {
+	return func(c *Config) {
+		for metric, t := range thresholds {
+			c.statsThresholds[metric] = t
+		}
+	}
+}
+
+// WithStatsInterfaces sets the network interfaces shown on the stats screen
+func WithStatsInterfaces(names []string) Option {
+	return func(c *Config) {
+		c.statsInterfaces = names
+	}
+}
+
+// WithFontsDir sets the directory fonts are loaded from, in addition to the
+// built-in ones
+func WithFontsDir(dir string) Option {
+	return func(c *Config) {
+		c.fontsDir = dir
+	}
+}
+
+// WithFontFamily sets the family text is drawn in by default
+func WithFontFamily(family string) Option {
+	return func(c *Config) {
+		c.fontFamily = family
+	}
+}
+
+// WithIdleTimeout sets how long the display stays on after the last draw
+// before it goes to sleep. 0 keeps it on.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.idleTimeout = timeout
+	}
+}
+
+// WithDiskReportTTL sets how long a disk report is served before a new one is
+// collected
+func WithDiskReportTTL(ttl time.Duration) Option {
+	return func(c *Config) {
+		c.diskReportTTL = ttl
+	}
+}
+
+// WithQuietHours sets when the display is dimmed to brightness, or blanked
+// if brightness is 0, and the background screens stop being redrawn
+func WithQuietHours(schedule *QuietSchedule, brightness int) Option {
+	return func(c *Config) {
+		c.quietHours = schedule
+		c.quietBrightness = brightness
+	}
 }
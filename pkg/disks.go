@@ -0,0 +1,546 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DiskReportVersion is the version of the /disk-stats schema. It changes
+// whenever a field is removed or changes meaning.
+const DiskReportVersion = 1
+
+// DefaultDiskReportTTL is how long a disk report is served before it is
+// collected again
+const DefaultDiskReportTTL = time.Minute
+
+// Timeouts of the commands the disk report runs
+const (
+	lvmTimeout = 5 * time.Second
+	k3sTimeout = 5 * time.Second
+	// duTimeout bounds walking the k3s storage directory, which can hold
+	// a lot of files
+	duTimeout = 30 * time.Second
+)
+
+// K3sDir is where k3s keeps its data
+const K3sDir = "/var/lib/rancher/k3s"
+
+// DiskReport is the response of /disk-stats
+type DiskReport struct {
+	Version     int       `json:"version"`
+	CollectedAt time.Time `json:"collectedAt"`
+	// Stale is set when the report is older than the TTL and a new one is
+	// being collected
+	Stale        bool          `json:"stale"`
+	BlockDevices []BlockDevice `json:"blockDevices"`
+	Mounts       []Mount       `json:"mounts"`
+	// LVM is left out when the LVM tools are not installed
+	LVM *LVMReport `json:"lvm,omitempty"`
+	// K3s is left out when k3s is not installed
+	K3s *K3sReport `json:"k3s,omitempty"`
+	// Errors lists the parts of the report that could not be collected
+	Errors []string `json:"errors,omitempty"`
+}
+
+// BlockDevice is a disk from /sys/block
+type BlockDevice struct {
+	Name       string      `json:"name"`
+	Model      string      `json:"model,omitempty"`
+	Vendor     string      `json:"vendor,omitempty"`
+	SizeBytes  uint64      `json:"sizeBytes"`
+	Rotational bool        `json:"rotational"`
+	Removable  bool        `json:"removable"`
+	ReadOnly   bool        `json:"readOnly"`
+	Partitions []Partition `json:"partitions"`
+}
+
+// Partition is a partition of a block device
+type Partition struct {
+	Name       string `json:"name"`
+	Number     int    `json:"number"`
+	StartBytes uint64 `json:"startBytes"`
+	SizeBytes  uint64 `json:"sizeBytes"`
+}
+
+// Mount is a mounted block device from /proc/mounts with its usage
+type Mount struct {
+	Device         string   `json:"device"`
+	MountPoint     string   `json:"mountPoint"`
+	FSType         string   `json:"fsType"`
+	Options        []string `json:"options"`
+	TotalBytes     uint64   `json:"totalBytes"`
+	UsedBytes      uint64   `json:"usedBytes"`
+	AvailableBytes uint64   `json:"availableBytes"`
+	TotalInodes    uint64   `json:"totalInodes"`
+	FreeInodes     uint64   `json:"freeInodes"`
+}
+
+// LVMReport lists the LVM volume groups, logical and physical volumes
+type LVMReport struct {
+	VolumeGroups    []VolumeGroup    `json:"volumeGroups"`
+	LogicalVolumes  []LogicalVolume  `json:"logicalVolumes"`
+	PhysicalVolumes []PhysicalVolume `json:"physicalVolumes"`
+}
+
+// VolumeGroup is an LVM volume group from vgs
+type VolumeGroup struct {
+	Name      string `json:"name"`
+	SizeBytes uint64 `json:"sizeBytes"`
+	FreeBytes uint64 `json:"freeBytes"`
+	PVCount   int    `json:"pvCount"`
+	LVCount   int    `json:"lvCount"`
+}
+
+// LogicalVolume is an LVM logical volume from lvs
+type LogicalVolume struct {
+	Name        string `json:"name"`
+	VolumeGroup string `json:"volumeGroup"`
+	Path        string `json:"path,omitempty"`
+	SizeBytes   uint64 `json:"sizeBytes"`
+	Attributes  string `json:"attributes"`
+}
+
+// PhysicalVolume is a disk or partition LVM uses, from pvs
+type PhysicalVolume struct {
+	Name        string `json:"name"`
+	VolumeGroup string `json:"volumeGroup,omitempty"`
+	Format      string `json:"format"`
+	SizeBytes   uint64 `json:"sizeBytes"`
+	FreeBytes   uint64 `json:"freeBytes"`
+}
+
+// K3sReport describes the k3s installation
+type K3sReport struct {
+	Version string `json:"version,omitempty"`
+	// StorageBytes is the size of each directory in the k3s local storage
+	StorageBytes map[string]uint64 `json:"storageBytes,omitempty"`
+}
+
+// errNotInstalled is returned by runCommand when the command is missing
+var errNotInstalled = errors.New("not installed")
+
+// runCommand runs a command, killing it after timeout
+func runCommand(ctx context.Context, timeout time.Duration, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, errNotInstalled
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %v", name, timeout)
+		}
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// readSysfs reads a value from a sysfs file, trimming the newline
+func readSysfs(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysfsUint(path string) uint64 {
+	v, _ := strconv.ParseUint(readSysfs(path), 10, 64)
+	return v
+}
+
+// sectorSize is the unit of the sizes in /sys/block, whatever the device's
+// own sector size
+const sectorSize = 512
+
+// collectBlockDevices lists the disks in /sys/block, leaving out loop and
+// ram devices
+func collectBlockDevices() ([]BlockDevice, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	devices := []BlockDevice{}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		dir := filepath.Join("/sys/block", name)
+		d := BlockDevice{
+			Name:       name,
+			Model:      readSysfs(filepath.Join(dir, "device", "model")),
+			Vendor:     readSysfs(filepath.Join(dir, "device", "vendor")),
+			SizeBytes:  readSysfsUint(filepath.Join(dir, "size")) * sectorSize,
+			Rotational: readSysfs(filepath.Join(dir, "queue", "rotational")) == "1",
+			Removable:  readSysfs(filepath.Join(dir, "removable")) == "1",
+			ReadOnly:   readSysfs(filepath.Join(dir, "ro")) == "1",
+			Partitions: []Partition{},
+		}
+		parts, _ := ioutil.ReadDir(dir)
+		for _, p := range parts {
+			partDir := filepath.Join(dir, p.Name())
+			number := readSysfs(filepath.Join(partDir, "partition"))
+			if number == "" {
+				continue
+			}
+			n, _ := strconv.Atoi(number)
+			d.Partitions = append(d.Partitions, Partition{
+				Name:       p.Name(),
+				Number:     n,
+				StartBytes: readSysfsUint(filepath.Join(partDir, "start")) * sectorSize,
+				SizeBytes:  readSysfsUint(filepath.Join(partDir, "size")) * sectorSize,
+			})
+		}
+		sort.Slice(d.Partitions, func(i, j int) bool { return d.Partitions[i].Number < d.Partitions[j].Number })
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// unescapeMount undoes the octal escapes of spaces and tabs in /proc/mounts
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// collectMounts lists the block devices in /proc/mounts with their usage
+func collectMounts() ([]Mount, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mounts := []Mount{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		m := Mount{
+			Device:     unescapeMount(fields[0]),
+			MountPoint: unescapeMount(fields[1]),
+			FSType:     fields[2],
+			Options:    strings.Split(fields[3], ","),
+		}
+		if seen[m.MountPoint] {
+			continue
+		}
+		seen[m.MountPoint] = true
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(m.MountPoint, &st); err == nil {
+			size := uint64(st.Frsize)
+			if size == 0 {
+				size = uint64(st.Bsize)
+			}
+			m.TotalBytes = uint64(st.Blocks) * size
+			m.UsedBytes = (uint64(st.Blocks) - uint64(st.Bfree)) * size
+			m.AvailableBytes = uint64(st.Bavail) * size
+			m.TotalInodes = uint64(st.Files)
+			m.FreeInodes = uint64(st.Ffree)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// lvmReport runs one of the LVM reporting commands, decoding the rows of
+// its JSON report into rows
+func lvmReport(ctx context.Context, command, key, fields string, rows interface{}) error {
+	out, err := runCommand(ctx, lvmTimeout, command, "--reportformat", "json", "--units", "b", "--nosuffix", "-o", fields)
+	if err != nil {
+		return err
+	}
+	var report struct {
+		Report []map[string]json.RawMessage `json:"report"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return fmt.Errorf("%s: %v", command, err)
+	}
+	if len(report.Report) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(report.Report[0][key], rows); err != nil {
+		return fmt.Errorf("%s: %v", command, err)
+	}
+	return nil
+}
+
+// lvmNumber parses a number in an LVM report, which are strings
+func lvmNumber(s string) uint64 {
+	v, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(s), "B"), 10, 64)
+	return v
+}
+
+// collectLVM lists the LVM volumes, returning nil if LVM is not installed
+func collectLVM(ctx context.Context) (*LVMReport, []error) {
+	var vgs []struct {
+		Name    string `json:"vg_name"`
+		Size    string `json:"vg_size"`
+		Free    string `json:"vg_free"`
+		PVCount string `json:"pv_count"`
+		LVCount string `json:"lv_count"`
+	}
+	err := lvmReport(ctx, "vgs", "vg", "vg_name,vg_size,vg_free,pv_count,lv_count", &vgs)
+	if err == errNotInstalled {
+		return nil, nil
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	report := &LVMReport{
+		VolumeGroups:    []VolumeGroup{},
+		LogicalVolumes:  []LogicalVolume{},
+		PhysicalVolumes: []PhysicalVolume{},
+	}
+	for _, vg := range vgs {
+		report.VolumeGroups = append(report.VolumeGroups, VolumeGroup{
+			Name:      vg.Name,
+			SizeBytes: lvmNumber(vg.Size),
+			FreeBytes: lvmNumber(vg.Free),
+			PVCount:   int(lvmNumber(vg.PVCount)),
+			LVCount:   int(lvmNumber(vg.LVCount)),
+		})
+	}
+
+	var lvs []struct {
+		Name string `json:"lv_name"`
+		VG   string `json:"vg_name"`
+		Path string `json:"lv_path"`
+		Size string `json:"lv_size"`
+		Attr string `json:"lv_attr"`
+	}
+	if err := lvmReport(ctx, "lvs", "lv", "lv_name,vg_name,lv_path,lv_size,lv_attr", &lvs); err != nil {
+		errs = append(errs, err)
+	}
+	for _, lv := range lvs {
+		report.LogicalVolumes = append(report.LogicalVolumes, LogicalVolume{
+			Name:        lv.Name,
+			VolumeGroup: lv.VG,
+			Path:        lv.Path,
+			SizeBytes:   lvmNumber(lv.Size),
+			Attributes:  lv.Attr,
+		})
+	}
+
+	var pvs []struct {
+		Name   string `json:"pv_name"`
+		VG     string `json:"vg_name"`
+		Format string `json:"pv_fmt"`
+		Size   string `json:"pv_size"`
+		Free   string `json:"pv_free"`
+	}
+	if err := lvmReport(ctx, "pvs", "pv", "pv_name,vg_name,pv_fmt,pv_size,pv_free", &pvs); err != nil {
+		errs = append(errs, err)
+	}
+	for _, pv := range pvs {
+		report.PhysicalVolumes = append(report.PhysicalVolumes, PhysicalVolume{
+			Name:        pv.Name,
+			VolumeGroup: pv.VG,
+			Format:      pv.Format,
+			SizeBytes:   lvmNumber(pv.Size),
+			FreeBytes:   lvmNumber(pv.Free),
+		})
+	}
+	return report, errs
+}
+
+// collectK3s reports the k3s version and how much each directory of its
+// local storage holds, returning nil if k3s is not installed
+func collectK3s(ctx context.Context) (*K3sReport, []error) {
+	out, err := runCommand(ctx, k3sTimeout, "k3s", "--version")
+	if err == errNotInstalled {
+		return nil, nil
+	}
+	var errs []error
+	report := &K3sReport{}
+	if err != nil {
+		errs = append(errs, err)
+	} else if lines := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2); len(lines) > 0 {
+		report.Version = lines[0]
+	}
+
+	storage := filepath.Join(K3sDir, "storage")
+	if _, err := os.Stat(storage); err != nil {
+		return report, errs
+	}
+	out, err = runCommand(ctx, duTimeout, "du", "-b", "--max-depth=1", storage)
+	if err != nil {
+		return report, append(errs, err)
+	}
+	report.StorageBytes = make(map[string]uint64)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || fields[1] == storage {
+			continue
+		}
+		report.StorageBytes[filepath.Base(fields[1])] = lvmNumber(fields[0])
+	}
+	return report, errs
+}
+
+// collectDiskReport builds a new disk report
+func collectDiskReport(ctx context.Context) *DiskReport {
+	r := &DiskReport{Version: DiskReportVersion, BlockDevices: []BlockDevice{}, Mounts: []Mount{}}
+	var errs []error
+	if devices, err := collectBlockDevices(); err != nil {
+		errs = append(errs, fmt.Errorf("block devices: %v", err))
+	} else {
+		r.BlockDevices = devices
+	}
+	if mounts, err := collectMounts(); err != nil {
+		errs = append(errs, fmt.Errorf("mounts: %v", err))
+	} else {
+		r.Mounts = mounts
+	}
+
+	// the commands are slow, run them side by side
+	var wg sync.WaitGroup
+	var lvmErrs, k3sErrs []error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.LVM, lvmErrs = collectLVM(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		r.K3s, k3sErrs = collectK3s(ctx)
+	}()
+	wg.Wait()
+	errs = append(errs, lvmErrs...)
+	errs = append(errs, k3sErrs...)
+
+	for _, err := range errs {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	r.CollectedAt = time.Now()
+	return r
+}
+
+// diskReporter collects disk reports in the background and serves the
+// last one until it is older than the TTL
+type diskReporter struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	report *DiskReport
+	// done is closed when the collection in progress finishes, nil when
+	// none is running
+	done chan struct{}
+}
+
+// init collects the first report in the background, so it is ready by the
+// time it is asked for
+func (d *diskReporter) init(ttl time.Duration) {
+	d.ttl = ttl
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshLocked()
+}
+
+// refreshLocked starts collecting a new report unless that is already
+// happening, returning a channel closed once it is done
+func (d *diskReporter) refreshLocked() chan struct{} {
+	if d.done != nil {
+		return d.done
+	}
+	done := make(chan struct{})
+	d.done = done
+	go func() {
+		report := collectDiskReport(context.Background())
+		d.mu.Lock()
+		d.report = report
+		d.done = nil
+		d.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// Report returns the cached report, collecting a new one in the background
+// once it is older than the TTL. It waits for a fresh report if there is
+// none yet or fresh is set.
+func (d *diskReporter) Report(ctx context.Context, fresh bool) (DiskReport, error) {
+	d.mu.Lock()
+	report := d.report
+	stale := report == nil || time.Since(report.CollectedAt) > d.ttl
+	var done chan struct{}
+	if stale || fresh {
+		done = d.refreshLocked()
+	}
+	d.mu.Unlock()
+
+	if report != nil && !fresh {
+		r := *report
+		r.Stale = stale
+		return r, nil
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return DiskReport{}, newError(http.StatusServiceUnavailable, "disk_report_pending", "The disk report is still being collected, try again later", ctx.Err())
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return *d.report, nil
+}
+
+// DiskStats reports the disks, partitions, mounts, LVM volumes and k3s
+// storage. The report is collected in the background and cached, pass
+// ?refresh=true to wait for a new one.
+func (b *PiboxFrameBuffer) DiskStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	fresh := false
+	if v := req.URL.Query().Get("refresh"); v != "" {
+		var err error
+		if fresh, err = strconv.ParseBool(v); err != nil {
+			writeError(w, badRequest("invalid_parameter", "refresh must be true or false", err))
+			return
+		}
+	}
+	report, err := b.disks.Report(req.Context(), fresh)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Error is an error returned by a handler. It is written to the client as a
+// JSON body with the matching HTTP status code.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+
+	// Elements lists what is wrong with each invalid element of a /render
+	// scene
+	Elements []ElementError `json:"elements,omitempty"`
+
+	// RetryAfter is sent as the Retry-After header in seconds when set
+	RetryAfter int `json:"-"`
+}
+
+// ElementError is a problem with one element of a /render scene
+type ElementError struct {
+	// Index is the element's position in the scene, from 0
+	Index   int    `json:"index"`
+	Type    string `json:"type,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.Detail)
+}
+
+func newError(status int, code string, message string, err error) *Error {
+	e := &Error{Status: status, Code: code, Message: message}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	return e
+}
+
+// badRequest reports invalid input from the client
+func badRequest(code string, message string, err error) *Error {
+	return newError(http.StatusBadRequest, code, message, err)
+}
+
+// methodNotAllowed reports a request with an unsupported method
+func methodNotAllowed(w http.ResponseWriter, allow string) *Error {
+	w.Header().Set("Allow", allow)
+	return newError(http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Use %s", allow), nil)
+}
+
+// displayUnavailable reports that the display could not be opened
+func displayUnavailable(err error) *Error {
+	return newError(http.StatusServiceUnavailable, "display_unavailable", "Could not open the display", err)
+}
+
+// displayError reports a failure talking to an open display
+func displayError(err error) *Error {
+	return newError(http.StatusInternalServerError, "display_error", "Could not draw to the display", err)
+}
+
+// internalError reports any other failure on our side
+func internalError(message string, err error) *Error {
+	return newError(http.StatusInternalServerError, "internal_error", message, err)
+}
+
+// writeError writes err as a JSON error body. Errors that are not an *Error
+// are reported as internal errors.
+func writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = internalError("Internal error", err)
+	}
+	counters.error(e.Code)
+	if e.Status >= http.StatusInternalServerError {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// MaxCachedFaces is how many font faces are kept around for reuse
+const MaxCachedFaces = 48
+
+// MaxFaceCacheBytes is how much memory the glyph masks of the cached faces
+// may take up together
+const MaxFaceCacheBytes = 64 << 20
+
+// maxFaceMaskBytes is how much memory the glyph masks of one face may take
+// up. A face keeps a mask as large as its largest glyph for each glyph it
+// caches, so large sizes cache fewer glyphs.
+const maxFaceMaskBytes = 4 << 20
+
+// defaultGlyphCacheEntries is how many glyphs a face caches unless that
+// takes more than maxFaceMaskBytes
+const defaultGlyphCacheEntries = 512
+
+// preloadFaceSizes are the sizes of the default family's regular and bold
+// faces created on startup, the ones the built-in screens draw with
+var preloadFaceSizes = []float64{12, 14, 16, 18, 20, 22, 24, 28, 32}
+
+// FontCacheStats reports how often a cached font face could be reused
+type FontCacheStats struct {
+	Faces int `json:"faces"`
+	// Bytes is the memory taken up by the glyph masks of the faces
+	Bytes     int    `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type faceKey struct {
+	family string
+	weight string
+	size   float64
+}
+
+// faceCache holds the font faces of the fonts in a registry by family,
+// weight and size
+type faceCache struct {
+	mu    sync.Mutex
+	faces map[faceKey]cachedFace
+	bytes int
+	stats FontCacheStats
+}
+
+type cachedFace struct {
+	face  *lockedFace
+	bytes int
+}
+
+// get returns the cached face for key, creating it with newFace on a miss.
+// newFace also returns the memory the face takes up.
+func (c *faceCache) get(key faceKey, newFace func() (font.Face, int)) font.Face {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.faces[key]; ok {
+		c.stats.Hits++
+		return f.face
+	}
+	c.stats.Misses++
+	if c.faces == nil {
+		c.faces = make(map[faceKey]cachedFace)
+	}
+	face, bytes := newFace()
+	// drop any faces, sizes are rarely reused in a pattern worth tracking
+	for k, f := range c.faces {
+		if len(c.faces) < MaxCachedFaces && c.bytes+bytes <= MaxFaceCacheBytes {
+			break
+		}
+		delete(c.faces, k)
+		c.bytes -= f.bytes
+		c.stats.Evictions++
+	}
+	f := cachedFace{face: &lockedFace{face: face}, bytes: bytes}
+	c.faces[key] = f
+	c.bytes += bytes
+	return f.face
+}
+
+// reset drops the cached faces, after the fonts they were made from changed
+func (c *faceCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faces = nil
+	c.bytes = 0
+}
+
+func (c *faceCache) Stats() FontCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Faces = len(c.faces)
+	s.Bytes = c.bytes
+	return s
+}
+
+// newFace creates a face of f at size points, caching as many glyphs as fit
+// in maxFaceMaskBytes. It returns the face and the memory its masks take up.
+func newFace(f *truetype.Font, size float64) (font.Face, int) {
+	// the mask of each glyph is as large as the font's bounds, the way
+	// truetype.NewFace works them out
+	b := f.Bounds(fixed.Int26_6(0.5 + size*64))
+	w := +int(b.Max.X+63)>>6 - +int(b.Min.X)>>6
+	h := -int(b.Min.Y-63)>>6 - -int(b.Max.Y)>>6
+	entries := defaultGlyphCacheEntries
+	for entries > 1 && w*h*entries > maxFaceMaskBytes {
+		entries /= 2
+	}
+	face := truetype.NewFace(f, &truetype.Options{Size: size, GlyphCacheEntries: entries})
+	return face, w * h * entries
+}
+
+// lockedFace lets renderers on several goroutines share a face, which on
+// its own caches glyphs without any locking
+type lockedFace struct {
+	mu   sync.Mutex
+	face font.Face
+}
+
+func (f *lockedFace) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.face.Close()
+}
+
+func (f *lockedFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dr, mask, maskp, advance, ok := f.face.Glyph(dot, r)
+	if !ok || mask == nil {
+		return dr, mask, maskp, advance, ok
+	}
+	// the face reuses its mask for the next glyph, so hand out a copy
+	m := image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+	draw.Draw(m, m.Rect, mask, maskp, draw.Src)
+	return dr, m, image.Point{}, advance, ok
+}
+
+func (f *lockedFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.face.GlyphBounds(r)
+}
+
+func (f *lockedFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.face.GlyphAdvance(r)
+}
+
+func (f *lockedFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.face.Kern(r0, r1)
+}
+
+func (f *lockedFace) Metrics() font.Metrics {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.face.Metrics()
+}
@@ -0,0 +1,295 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// DefaultFontsDir is where fonts are loaded from unless FONTS_DIR says
+// otherwise
+const DefaultFontsDir = "/usr/share/fonts/truetype/piboto"
+
+// DefaultFontFamily is the family text is drawn in unless a request names
+// another. FallbackFontFamily is used when it is not installed.
+const (
+	DefaultFontFamily  = "piboto"
+	FallbackFontFamily = "go"
+)
+
+// Font weights every family has, falling back to regular if need be
+const (
+	WeightRegular = "regular"
+	WeightBold    = "bold"
+)
+
+// builtinFonts are compiled into the binary so text can be drawn on any
+// system
+var builtinFonts = []struct {
+	family, weight string
+	ttf            []byte
+}{
+	{"go", WeightRegular, goregular.TTF},
+	{"go", WeightBold, gobold.TTF},
+	{"go", "italic", goitalic.TTF},
+	{"go", "bold-italic", gobolditalic.TTF},
+	{"go-mono", WeightRegular, gomono.TTF},
+	{"go-mono", WeightBold, gomonobold.TTF},
+}
+
+// fonts are the fonts all renderers draw text with
+var fonts = newFontRegistry()
+
+// fontRegistry holds the parsed fonts by family and weight
+type fontRegistry struct {
+	mu            sync.RWMutex
+	families      map[string]map[string]*truetype.Font
+	defaultFamily string
+
+	faces faceCache
+}
+
+func newFontRegistry() *fontRegistry {
+	r := &fontRegistry{
+		families:      make(map[string]map[string]*truetype.Font),
+		defaultFamily: FallbackFontFamily,
+	}
+	for _, f := range builtinFonts {
+		parsed, err := truetype.Parse(f.ttf)
+		if err != nil {
+			panic(fmt.Sprintf("built-in font %s %s: %v", f.family, f.weight, err))
+		}
+		r.add(f.family, f.weight, parsed)
+	}
+	return r
+}
+
+func (r *fontRegistry) add(family, weight string, f *truetype.Font) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	weights, ok := r.families[family]
+	if !ok {
+		weights = make(map[string]*truetype.Font)
+		r.families[family] = weights
+	}
+	weights[weight] = f
+	r.faces.reset()
+}
+
+// fontKey turns a name from a font file, like "Bold Italic", into a family
+// or weight name, like "bold-italic"
+func fontKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// weightKey is fontKey for weights, naming the plain weight regular however
+// the font calls it
+func weightKey(name string) string {
+	switch key := fontKey(name); key {
+	case "", "book", "normal", "roman", "plain":
+		return WeightRegular
+	default:
+		return key
+	}
+}
+
+// LoadDir registers the TrueType fonts in dir and its subdirectories under
+// the family and weight named in each file, returning how many it loaded.
+// Files that can not be parsed are skipped.
+func (r *fontRegistry) LoadDir(dir string) (int, error) {
+	loaded := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".ttf") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read font %s: %v\n", path, err)
+			return nil
+		}
+		f, err := truetype.Parse(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse font %s: %v\n", path, err)
+			return nil
+		}
+		family := fontKey(f.Name(truetype.NameIDFontFamily))
+		weight := weightKey(f.Name(truetype.NameIDFontSubfamily))
+		if family == "" {
+			// fall back to the file name, like Piboto-Bold.ttf
+			name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			family, weight = name, WeightRegular
+			if i := strings.LastIndex(name, "-"); i > 0 {
+				family, weight = name[:i], name[i+1:]
+			}
+			family, weight = fontKey(family), weightKey(weight)
+		}
+		r.add(family, weight, f)
+		loaded++
+		return nil
+	})
+	return loaded, err
+}
+
+// SetDefault sets the family used when a request names none
+func (r *fontRegistry) SetDefault(family string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[family]; !ok {
+		return unknownFont(family)
+	}
+	r.defaultFamily = family
+	return nil
+}
+
+func unknownFont(family string) *Error {
+	return badRequest("unknown_font", fmt.Sprintf("There is no font family %q, GET /fonts lists them", family), nil)
+}
+
+// has reports whether family is registered, the empty string being the
+// default family
+func (r *fontRegistry) has(family string) bool {
+	if family == "" {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.families[family]
+	return ok
+}
+
+// resolve returns the font of a family and weight, and the family and
+// weight it picked. An empty family is the default one, and a weight the
+// family lacks falls back to regular, or any weight it has.
+func (r *fontRegistry) resolve(family, weight string) (*truetype.Font, string, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if family == "" {
+		family = r.defaultFamily
+	}
+	weights, ok := r.families[family]
+	if !ok {
+		return nil, "", "", unknownFont(family)
+	}
+	if f, ok := weights[weight]; ok {
+		return f, family, weight, nil
+	}
+	if f, ok := weights[WeightRegular]; ok {
+		return f, family, WeightRegular, nil
+	}
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return weights[names[0]], family, names[0], nil
+}
+
+// face returns a face of the font at size points, shared with every other
+// caller asking for the same one. Sizes are rounded to whole points from 1 to
+// MaxTextSize, so a few faces serve every size asked for.
+func (r *fontRegistry) face(family, weight string, size float64) (font.Face, error) {
+	f, family, weight, err := r.resolve(family, weight)
+	if err != nil {
+		return nil, err
+	}
+	size = math.Min(math.Max(math.Round(size), 1), MaxTextSize)
+	return r.faces.get(faceKey{family, weight, size}, func() (font.Face, int) {
+		return newFace(f, size)
+	}), nil
+}
+
+// preload creates the faces of the default family the built-in screens
+// draw with
+func (r *fontRegistry) preload() {
+	for _, weight := range []string{WeightRegular, WeightBold} {
+		for _, size := range preloadFaceSizes {
+			r.face("", weight, size)
+		}
+	}
+}
+
+// FontFamily describes a font family in the response of /fonts
+type FontFamily struct {
+	Family  string   `json:"family"`
+	Weights []string `json:"weights"`
+	Default bool     `json:"default,omitempty"`
+}
+
+func (r *fontRegistry) list() []FontFamily {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	families := make([]FontFamily, 0, len(r.families))
+	for family, weights := range r.families {
+		f := FontFamily{Family: family, Default: family == r.defaultFamily}
+		for weight := range weights {
+			f.Weights = append(f.Weights, weight)
+		}
+		sort.Strings(f.Weights)
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Family < families[j].Family })
+	return families
+}
+
+// setFont sets the face dc draws text with
+func setFont(dc *gg.Context, family, weight string, size float64) error {
+	face, err := fonts.face(family, weight, size)
+	if err != nil {
+		return err
+	}
+	dc.SetFontFace(face)
+	return nil
+}
+
+// loadFont sets dc to draw text in the default family
+func loadFont(dc *gg.Context, size float64, bold bool) error {
+	weight := WeightRegular
+	if bold {
+		weight = WeightBold
+	}
+	return setFont(dc, "", weight, size)
+}
+
+// loadFonts registers the fonts in the configured directory, picks the
+// default family and preloads its faces
+func (b *PiboxFrameBuffer) loadFonts() {
+	if dir := b.config.fontsDir; dir != "" {
+		if _, err := fonts.LoadDir(dir); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Could not load fonts from %s: %v\n", dir, err)
+		}
+	}
+	if err := fonts.SetDefault(b.config.fontFamily); err != nil && b.config.fontFamily != DefaultFontFamily {
+		fmt.Fprintf(os.Stderr, "Font family %s is not installed, falling back to %s\n", b.config.fontFamily, FallbackFontFamily)
+	}
+	fonts.preload()
+}
+
+// Fonts lists the font families text can be drawn in
+func (b *PiboxFrameBuffer) Fonts(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fonts.list())
+}
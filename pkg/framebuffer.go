@@ -1,30 +1,21 @@
 package pkg
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
-	"image/gif"
-	"io/ioutil"
-	"math"
-	"net"
+	"image/draw"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
-	"strconv"
-	"strings"
 	"time"
 
-	human "github.com/dustin/go-humanize"
 	"github.com/fogleman/gg"
-	"github.com/rakyll/statik/fs"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/disk"
-	"github.com/shirou/gopsutil/mem"
-	"github.com/skip2/go-qrcode"
+	"github.com/kubesail/pibox-framebuffer/backlight"
 	"github.com/kubesail/pibox-framebuffer/display"
+	"github.com/rakyll/statik/fs"
 )
 
 const DefaultScreenSize = 240
@@ -32,18 +23,54 @@ const DefaultScreenSize = 240
 type PiboxFrameBuffer struct {
 	config *Config
 
-	// enableStats will cycle the statistics screen if set to true
-	enableStats bool
+	// stats redraws the stats screen on the background layer
+	stats statsRunner
+
+	// player plays animations in the background, any other draw stops it
+	player player
+
+	// queue owns the display, every draw goes through it
+	queue *renderQueue
+
+	// layers are composited to make up the screen
+	layers *layerStack
+
+	// notifier shows notifications on the notification layer
+	notifier notifier
+
+	// carousel cycles through pages on the carousel layer
+	carousel carousel
+
+	// disks collects and caches the disk report of /disk-stats
+	disks diskReporter
+
+	// idle puts the display to sleep when nothing was drawn for a while
+	idle idleTimer
+
+	// quiet dims or blanks the display during quiet hours
+	quiet quietHours
+}
+
+// readFrameBuffer returns the display for handlers that only read its state.
+// Anything that talks to the device goes through the render queue.
+func readFrameBuffer() (*display.Display, error) {
+	fb, err := display.Init()
+	if err != nil {
+		return nil, displayUnavailable(err)
+	}
+	return fb, nil
 }
 
-func (b *PiboxFrameBuffer) openFrameBuffer() (*display.Display) {
+func (b *PiboxFrameBuffer) openFrameBuffer() (*display.Display, error) {
 	fb, err := display.Init()
 	if err != nil {
-		panic(err)
+		return nil, displayUnavailable(err)
+	}
+	if err := fb.Rotate(display.ROTATION_270); err != nil {
+		return nil, displayError(err)
 	}
-	fb.Rotate(display.ROTATION_270)
 	// defer fb.Close()
-	return fb
+	return fb, nil
 }
 
 type RGB struct {
@@ -56,401 +83,239 @@ func (b *PiboxFrameBuffer) RGB(w http.ResponseWriter, req *http.Request) {
 	var c RGB
 	err := json.NewDecoder(req.Body).Decode(&c)
 	if err != nil {
-		http.Error(w, "Requires json body with R, G, and B keys! Values must be 0-255\n", http.StatusBadRequest)
+		writeError(w, badRequest("invalid_json", "Requires json body with R, G, and B keys! Values must be 0-255", err))
 		return
 	}
 
-	b.DrawSolidColor(c)
+	if err := b.DrawSolidColor(c); err != nil {
+		writeError(w, err)
+		return
+	}
 	fmt.Fprintf(w, "parsed color: R%v G%v B%v\n", c.R, c.G, c.B)
 	fmt.Fprintf(w, "wrote to framebuffer!\n")
 }
 
-func (b *PiboxFrameBuffer) DrawSolidColor(c RGB) {
-	fb := b.openFrameBuffer()
-	fb.FillScreen(color.RGBA{c.R, c.G, c.B, 255})
-	b.enableStats = false
+func (b *PiboxFrameBuffer) DrawSolidColor(c RGB) error {
+	b.player.StopOn(LayerApp)
+	_, err := b.drawLayer(context.Background(), PriorityNormal, LayerApp, layerOptions{}, func(frame *image.RGBA) {
+		draw.Draw(frame, frame.Rect, &image.Uniform{color.RGBA{c.R, c.G, c.B, 255}}, image.Point{}, draw.Src)
+	})
+	return err
 }
 
-func (b *PiboxFrameBuffer) QR(w http.ResponseWriter, req *http.Request) {
-	query := req.URL.Query()
-	content, present := query["content"]
-	if !present {
-		http.Error(w, "Pass ?content= to render a QR code\n", http.StatusBadRequest)
-		return
+// TextOnContext draws content centred on x, y in the default font, wrapped
+// to the width of the screen
+func (b *PiboxFrameBuffer) TextOnContext(dc *gg.Context, x float64, y float64, size float64, content string, bold bool, align gg.Align) error {
+	if err := loadFont(dc, size, bold); err != nil {
+		return err
 	}
+	dc.DrawStringWrapped(content, x, y, 0.5, 0.5, float64(b.config.screenSize), 1.5, align)
+	return nil
+}
 
-	fb := b.openFrameBuffer()
-
-	// var q qrcode.QRCode
-	q, err := qrcode.New(strings.Join(content, ""), qrcode.Low)
-	q.DisableBorder = true
-	// q.ForegroundColor = color.RGBA{236, 57, 99, 255}
+// DrawImage draws an image to the app layer, or the layer given by ?layer=
+func (b *PiboxFrameBuffer) DrawImage(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	layer, err := queryLayer(query, LayerApp)
 	if err != nil {
-		panic(err)
+		writeError(w, err)
+		return
 	}
-	// var qr image.Image
-	img := q.Image(180)
-
-	// draw.Draw(fb,
-	//	image.Rectangle{Min: image.Point{X: 30, Y: 47}, Max: image.Point{X: 210, Y: 227}},
-	//	img,
-	//	image.Point{},
-	//	draw.Src)
-
-        fb.DrawRAW(img)
-
-	fmt.Println("QR Code printed to screen")
-	b.enableStats = false
-}
-
-type DiskStatsResponse struct {
-	BlockDevices    []string
-	Partitions      []string
-	Models          []string
-	RootUsage       []string
-	K3sUsage        []string
-	K3sStorageUsage []string
-	Lvs             string
-	Pvs             string
-	K3sVersion      string
-	K3sMount        string
-	MountPoints     string
+	if _, err := b.drawImage(req, layer); err != nil {
+		writeError(w, err)
+		return
+	}
+	if query.Get("x") != "" || query.Get("y") != "" {
+		fmt.Fprintf(w, "Region drawn\n")
+		return
+	}
+	fmt.Fprintf(w, "Image drawn\n")
 }
 
-func shell(app string, args []string) string {
-	cmd := exec.Command(app, args...)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+// drawImage draws the image in the body of req to a layer, scaled to the
+// screen or, with ?x= and ?y=, at its own size leaving the rest of the layer
+// untouched
+func (b *PiboxFrameBuffer) drawImage(req *http.Request, layer string) (LayerInfo, error) {
+	query := req.URL.Query()
+	layout, err := parseLayout(query)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to run \"%v\": %v\n", app, stderr.String())
-		return ""
-	} else {
-		return strings.Replace(strings.Trim(strings.Trim(stdout.String(), "\n"), " "), "\t", " ", -1)
+		return LayerInfo{}, err
 	}
-}
-
-func (b *PiboxFrameBuffer) DiskStats(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var responseData DiskStatsResponse
-
-	responseData.RootUsage = strings.Split(shell("df", strings.Split("/", " ")), "\n")
-	responseData.K3sUsage = strings.Split(shell("df", strings.Split("/var/lib/rancher/k3s/", " ")), "\n")
-	responseData.K3sStorageUsage = strings.Split(shell("du", strings.Split("-b --max-depth=1 /var/lib/rancher/k3s/storage/", " ")), "\n")
-	responseData.K3sVersion = shell("k3s", strings.Split("--version", " "))
-	responseData.MountPoints = shell("findmnt", strings.Split("-s -J -e", " "))
-	responseData.Lvs = shell("lvs", strings.Split("--reportformat json --units=b", " "))
-	responseData.Pvs = shell("pvs", strings.Split("--reportformat json --units=b", " "))
-
-	files, err := ioutil.ReadDir("/sys/block")
+	priority, err := queryPriority(query)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to stat /sys/block: %v\n", err)
-	} else {
-		for _, f := range files {
-			if strings.HasPrefix(f.Name(), "loop") {
-				continue
-			}
-			if strings.HasPrefix(f.Name(), "ram") {
-				continue
-			}
-
-			responseData.BlockDevices = append(responseData.BlockDevices, f.Name())
-
-			modelFilePath := fmt.Sprintf("/sys/block/%v/device/model", f.Name())
-			modelDataRaw, err := os.ReadFile(modelFilePath)
-			var modelData string
-			modelData = strings.Trim(strings.Trim(string(modelDataRaw), "\n"), " ")
-			if err != nil {
-				fmt.Println(f.Name())
-				fmt.Fprintf(os.Stderr, "Failed to collect model data: %v\n", err)
-			} else {
-				responseData.Models = append(responseData.Models, fmt.Sprintf("%v %v", f.Name(), modelData))
-			}
+		return LayerInfo{}, err
+	}
+	opts, err := parseLayerOptions(query)
+	if err != nil {
+		return LayerInfo{}, err
+	}
+	img, _, err := image.Decode(req.Body)
+	if err != nil {
+		return LayerInfo{}, badRequest("invalid_image", "Could not decode image, send a PNG, JPEG or GIF body", err)
+	}
 
-			partedOutputRaw := exec.Command("timeout", "2", "parted", fmt.Sprintf("/dev/%v", f.Name()), "print", "-m")
-			var partedOutputStdout bytes.Buffer
-			partedOutputRaw.Stdout = &partedOutputStdout
-			partedErr := partedOutputRaw.Run()
-			if partedErr != nil {
-				fmt.Println(f.Name())
-				fmt.Fprintf(os.Stderr, "Failed to call parted: %v\n", partedErr)
-			} else {
-				var partedOutput string
-				partedOutput = strings.Trim(strings.Trim(partedOutputStdout.String(), "\n"), " ")
-				responseData.Partitions = append(responseData.Partitions, fmt.Sprintf("%v %v", f.Name(), partedOutput))
-			}
-		}
+	// ?x= and ?y= blit the image at its own size, leaving the rest of the
+	// layer untouched
+	if query.Get("x") != "" || query.Get("y") != "" {
+		return b.drawRegion(req.Context(), priority, layer, opts, query, img)
 	}
-	json.NewEncoder(w).Encode(responseData)
+
+	screen := image.Pt(b.config.screenSize, b.config.screenSize)
+	rendered := layout.Render(img, screen)
+	b.player.StopOn(layer)
+	return b.drawLayer(req.Context(), priority, layer, opts, func(frame *image.RGBA) {
+		draw.Draw(frame, frame.Rect, rendered, image.Point{}, draw.Src)
+	})
 }
 
-func (b *PiboxFrameBuffer) TextRequest(w http.ResponseWriter, req *http.Request) {
-	query := req.URL.Query()
-	content := query["content"]
-	if len(content) == 0 {
-		content = append(content, "no content param")
-	}
-	background := query["background"]
-	dc := gg.NewContext(b.config.screenSize, b.config.screenSize)
-	if len(background) == 1 {
-		dc.SetHexColor(background[0])
-		dc.DrawRectangle(0, 0, 240, 240)
-		dc.Fill()
+func (b *PiboxFrameBuffer) drawRegion(ctx context.Context, priority Priority, layer string, opts layerOptions, query url.Values, img image.Image) (LayerInfo, error) {
+	x, err := queryInt(query, "x", 0)
+	if err != nil {
+		return LayerInfo{}, err
 	}
-	c := query["color"]
-	if len(c) > 0 {
-		dc.SetHexColor(c[0])
-	} else {
-		dc.SetHexColor("cccccc")
+	y, err := queryInt(query, "y", 0)
+	if err != nil {
+		return LayerInfo{}, err
 	}
-	size := query["size"]
-	if len(size) == 0 {
-		size = append(size, "22")
+	screen := image.Rect(0, 0, b.config.screenSize, b.config.screenSize)
+	rect := img.Bounds().Sub(img.Bounds().Min).Add(image.Pt(x, y))
+	if !rect.Overlaps(screen) {
+		return LayerInfo{}, badRequest("invalid_parameter", fmt.Sprintf("Region %v is outside the screen %v", rect, screen), nil)
 	}
-	sizeInt, _ := strconv.Atoi(size[0])
-	x := query["x"]
-	xInt := b.config.screenSize / 2
-	if len(x) > 0 {
-		xInt, _ = strconv.Atoi(x[0])
+	b.player.StopOn(layer)
+	return b.drawLayer(ctx, priority, layer, opts, func(frame *image.RGBA) {
+		draw.Draw(frame, rect, img, img.Bounds().Min, draw.Src)
+	})
+}
+
+// Shutdown finishes the draws still queued, draws the configured shutdown
+// frame, fades the backlight out unless configured to leave it on, and
+// releases the display.
+func (b *PiboxFrameBuffer) Shutdown() error {
+	b.stopQuietHours()
+	b.StopStats()
+	b.player.Stop()
+	b.notifier.Close()
+	b.carousel.Close()
+	b.idle.Close()
+	b.queue.Close()
+	fb, err := b.openFrameBuffer()
+	if err != nil {
+		return err
 	}
-	y := query["y"]
-	yInt := b.config.screenSize / 2
-	if len(y) > 0 {
-		yInt, _ = strconv.Atoi(y[0])
+	defer fb.Close()
+	// the shutdown frame has to be seen
+	if err := b.wakeDisplay(fb); err != nil {
+		return err
 	}
 
-	b.TextOnContext(dc, float64(xInt), float64(yInt), float64(sizeInt), content[0], true, gg.AlignCenter)
-	b.flushTextToScreen(dc)
-	b.enableStats = false
-}
-
-func (b *PiboxFrameBuffer) TextOnContext(dc *gg.Context, x float64, y float64, size float64, content string, bold bool, align gg.Align) {
-	const S = 240
-	// dc.SetRGB(float64(c.R), float64(c.G), float64(c.B))
-	if bold {
-		if err := dc.LoadFontFace("/usr/share/fonts/truetype/piboto/Piboto-Bold.ttf", float64(size)); err != nil {
-			panic(err)
+	switch frame := b.config.shutdownFrame; frame {
+	case "", "none":
+	case "splash":
+		img, err := splashImage()
+		if err != nil {
+			return err
 		}
-	} else {
-		if err := dc.LoadFontFace("/usr/share/fonts/truetype/piboto/Piboto-Regular.ttf", float64(size)); err != nil {
-			panic(err)
+		if err := fb.DrawRAW(img); err != nil {
+			return displayError(err)
+		}
+	default:
+		if c, err := parseHexColor(frame); err == nil {
+			if err := fb.FillScreen(c); err != nil {
+				return displayError(err)
+			}
+			break
+		}
+		f, err := os.Open(frame)
+		if err != nil {
+			return fmt.Errorf("could not open shutdown frame: %v", err)
+		}
+		defer f.Close()
+		img, _, err := image.Decode(f)
+		if err != nil {
+			return fmt.Errorf("could not decode shutdown frame: %v", err)
+		}
+		if err := fb.DrawRAW(img); err != nil {
+			return displayError(err)
 		}
 	}
-	dc.DrawStringWrapped(content, x, y, 0.5, 0.5, 240, 1.5, align)
-	// dc.Clip()
-}
 
-func (b *PiboxFrameBuffer) flushTextToScreen(dc *gg.Context) {
-	fb := b.openFrameBuffer()
-	// draw.Draw(fb, fb.Bounds(), dc.Image(), image.Point{}, draw.Src)
-	fb.DrawRAW(dc.Image())
-}
-
-func (b *PiboxFrameBuffer) DrawImage(w http.ResponseWriter, req *http.Request) {
-	fb := b.openFrameBuffer()
-	img, _, err := image.Decode(req.Body)
-	if err != nil {
-		panic(err)
+	if !b.config.shutdownBacklight {
+		fb.Backlight().Off(b.config.backlightFade)
+		// closing the display stops the fade where it is
+		time.Sleep(b.config.backlightFade)
 	}
-	// draw.Draw(fb, fb.Bounds(), img, image.Point{}, draw.Src)
-	fb.DrawRAW(img)
-	fmt.Fprintf(w, "Image drawn\n")
-	b.enableStats = false
+	return nil
 }
 
-func (b *PiboxFrameBuffer) DrawGIF(w http.ResponseWriter, req *http.Request) {
-	fb := b.openFrameBuffer()
-	imgGif, err := gif.DecodeAll(req.Body)
+// Splash draws the splash screen packed into the binary to the background
+// layer
+func (b *PiboxFrameBuffer) Splash() error {
+	img, err := splashImage()
 	if err != nil {
-		panic(err)
-	}
-	for i, frame := range imgGif.Image {
-		// draw.Draw(fb, fb.Bounds(), frame, image.Point{}, draw.Src)
-		fb.DrawRAW(frame)
-		time.Sleep(time.Millisecond * 3 * time.Duration(imgGif.Delay[i]))
+		return err
 	}
-	fmt.Fprintf(w, "GIF drawn\n")
-	b.enableStats = false
+	b.player.StopOn(LayerBackground)
+	_, err = b.drawLayer(context.Background(), PriorityNormal, LayerBackground, layerOptions{}, func(frame *image.RGBA) {
+		draw.Draw(frame, frame.Rect, image.Black, image.Point{}, draw.Src)
+		draw.Draw(frame, frame.Rect, img, img.Bounds().Min, draw.Over)
+	})
+	return err
 }
 
-func (b *PiboxFrameBuffer) Exit() {
-	fb := b.openFrameBuffer()
-	fmt.Println("Received exit request, shutting down...")
-	c := color.RGBA{R: 0, G: 0, B: 255, A: 0}
-	// b.DrawSolidColor(c)
-	fb.FillScreen(c)
-}
-
-func (b *PiboxFrameBuffer) Splash() {
-	fb := b.openFrameBuffer()
-
-	fb.FillScreen(color.RGBA{R: 0, G: 0, B: 0, A: 0})
-
+func splashImage() (image.Image, error) {
 	statikFS, err := fs.New()
 	if err != nil {
-		panic(err)
+		return nil, internalError("Could not open embedded files", err)
 	}
 	r, err := statikFS.Open("/pibox-splash.png")
 	if err != nil {
-		panic(err)
+		return nil, internalError("Could not open splash screen", err)
 	}
+	defer r.Close()
 	img, _, err := image.Decode(r)
 	if err != nil {
-		panic(err)
+		return nil, internalError("Could not decode splash screen", err)
 	}
-	fb.DrawRAW(img)
-}
-
-func (b *PiboxFrameBuffer) EnableStats(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprintf(w, "Stats on\n")
-	b.enableStats = true
+	return img, nil
 }
 
-func (b *PiboxFrameBuffer) Stats() {
-	defer time.AfterFunc(3*time.Second, b.Stats)
-	if !b.enableStats {
-		return
-	}
-
-	// create new context and clear screen
-	dc := gg.NewContext(b.config.screenSize, b.config.screenSize)
-	dc.DrawRectangle(0, 0, 240, 240)
-	dc.SetColor(color.RGBA{51, 51, 51, 255})
-	dc.Fill()
-
-	var DISK_BAR_WIDTH float64 = 200
-	var DISK_BAR_HEIGHT float64 = 105
-	// outline
-	dc.DrawRoundedRectangle(20, DISK_BAR_HEIGHT, DISK_BAR_WIDTH, 40, 5)
-	dc.SetColor(color.RGBA{160, 160, 160, 255})
-	dc.Fill()
-	// inside
-	dc.DrawRoundedRectangle(21, DISK_BAR_HEIGHT+1, DISK_BAR_WIDTH-2, 38, 4)
-	dc.SetColor(color.RGBA{51, 51, 51, 255})
-	dc.Fill()
-
-	parts, _ := disk.Partitions(false)
-	var found = false
-	for _, p := range parts {
-		device := p.Mountpoint
-		if !strings.HasPrefix(device, b.config.diskMountPrefix) {
-			continue
-		}
-		s, _ := disk.Usage(device)
-
-		if s.Total == 0 {
-			continue
-		}
-
-		percent := fmt.Sprintf("%s / %s",
-			human.Bytes(s.Used),
-			human.Bytes(s.Total),
-		)
-
-		// usage
-		dc.DrawRoundedRectangle(21, DISK_BAR_HEIGHT+1, (s.UsedPercent/100.0)*(DISK_BAR_WIDTH-2), 38, 4)
-		dc.SetColor(color.RGBA{70, 70, 70, 255})
-		dc.Fill()
-
-		dc.SetColor(color.RGBA{160, 160, 160, 255})
-		b.TextOnContext(dc, 120, 125, 22, percent, false, gg.AlignCenter)
-		found = true
-	}
-	if !found {
-		dc.SetColor(color.RGBA{160, 160, 160, 255})
-		b.TextOnContext(dc, 120, 125, 22, "No SSD configured", false, gg.AlignCenter)
-	}
-
-	var cpuUsage, _ = cpu.Percent(0, false)
-	v, _ := mem.VirtualMemory()
-
-	dc.SetColor(color.RGBA{160, 160, 160, 255})
-	b.TextOnContext(dc, 70, 28, 22, "CPU", false, gg.AlignCenter)
-	cpuPercent := cpuUsage[0]
-	colorCpu := color.RGBA{183, 225, 205, 255}
-	if cpuPercent > 40 {
-		colorCpu = color.RGBA{252, 232, 178, 255}
-	}
-	if cpuPercent > 70 {
-		colorCpu = color.RGBA{244, 199, 195, 255}
-	}
-	dc.SetColor(colorCpu)
-	b.TextOnContext(dc, 70, 66, 30, fmt.Sprintf("%v%%", math.Round(cpuPercent)), true, gg.AlignCenter)
-	dc.SetColor(color.RGBA{160, 160, 160, 255})
-	b.TextOnContext(dc, 170, 28, 22, "MEM", false, gg.AlignCenter)
-	colorMem := color.RGBA{183, 225, 205, 255}
-	if cpuPercent > 40 {
-		colorMem = color.RGBA{252, 232, 178, 255}
-	}
-	if cpuPercent > 70 {
-		colorMem = color.RGBA{244, 199, 195, 255}
-	}
-	dc.SetColor(colorMem)
-	b.TextOnContext(dc, 170, 66, 30, fmt.Sprintf("%v%%", math.Round(v.UsedPercent)), true, gg.AlignCenter)
-
-	interfaces, _ := net.Interfaces()
-	for _, inter := range interfaces {
-		if inter.Name == "eth0" {
-			dc.SetColor(color.RGBA{160, 160, 160, 255})
-			b.TextOnContext(dc, 130, 180, 22, "eth", false, gg.AlignLeft)
-			addrs, _ := inter.Addrs()
-			var ipv4 = ""
-			for _, addr := range addrs {
-				ip := addr.String()
-				if strings.Contains(ip, ".") {
-					ipv4 = ip[:len(ip)-3] // assign and remove subnet mask
-				}
-			}
-			if ipv4 == "" {
-				dc.SetColor(color.RGBA{100, 100, 100, 255})
-				b.TextOnContext(dc, 110, 180, 22, "Disconnected", true, gg.AlignRight)
-			} else {
-				w, _ := dc.MeasureString(ipv4)
-				var fontSize float64 = 26
-				if w > 150 {
-					fontSize = 22
-				}
-				dc.SetColor(color.RGBA{180, 180, 180, 255})
-				b.TextOnContext(dc, 110, 180, fontSize, ipv4, true, gg.AlignRight)
-			}
-		} else if inter.Name == "wlan0" {
-			dc.SetColor(color.RGBA{180, 180, 180, 255})
-			b.TextOnContext(dc, 130, 210, 22, "wifi", false, gg.AlignLeft)
-			addrs, _ := inter.Addrs()
-			var ipv4 = ""
-			for _, addr := range addrs {
-				ip := addr.String()
-				if strings.Contains(ip, ".") {
-					ipv4 = ip[:len(ip)-3] // assign and remove subnet mask
-				}
-			}
-			if ipv4 == "" {
-				dc.SetColor(color.RGBA{100, 100, 100, 255})
-				b.TextOnContext(dc, 110, 210, 22, "Disconnected", true, gg.AlignRight)
-			} else {
-				w, _ := dc.MeasureString(ipv4)
-				var fontSize float64 = 26
-				if w > 150 {
-					fontSize = 22
-				}
-				dc.SetColor(color.RGBA{180, 180, 180, 255})
-				b.TextOnContext(dc, 110, 210, fontSize, ipv4, true, gg.AlignRight)
-			}
-
-		}
-	}
-	b.flushTextToScreen(dc)
-}
-
-func NewFrameBuffer(screenSize int, enableStats bool, diskMountPrefix string) *PiboxFrameBuffer {
+func NewFrameBuffer(screenSize int, enableStats bool, diskMountPrefix string, opts ...Option) *PiboxFrameBuffer {
 	buf := &PiboxFrameBuffer{
 		config: &Config{
-			screenSize:      screenSize,
-			diskMountPrefix: diskMountPrefix,
+			screenSize:        screenSize,
+			diskMountPrefix:   diskMountPrefix,
+			shutdownFrame:     DefaultShutdownFrame,
+			shutdownBacklight: true,
+			backlight:         backlight.Max,
+			backlightFade:     DefaultBacklightFade,
+			queueSize:         DefaultQueueSize,
+			statsWidgets:      DefaultStatsWidgets,
+			statsInterval:     DefaultStatsInterval,
+			statsThresholds:   make(map[string]Threshold),
+			fontsDir:          DefaultFontsDir,
+			fontFamily:        DefaultFontFamily,
+			diskReportTTL:     DefaultDiskReportTTL,
 		},
-		enableStats: enableStats,
+	}
+	for metric, t := range DefaultStatsThresholds {
+		buf.config.statsThresholds[metric] = t
+	}
+	for _, opt := range opts {
+		opt(buf.config)
+	}
+	buf.loadFonts()
+	buf.queue = newRenderQueue(buf.config.queueSize, buf.openFrameBuffer)
+	buf.layers = newLayerStack(image.Pt(screenSize, screenSize), buf.layerExpired)
+	buf.notifier.init()
+	go buf.showNotifications()
+	buf.carousel.init()
+	go buf.runCarousel()
+	buf.disks.init(buf.config.diskReportTTL)
+	buf.idle.init(buf.config.idleTimeout, buf.idleExpired)
+	buf.quiet.init(buf.config.quietHours, buf.config.quietBrightness)
+	if enableStats {
+		buf.StartStats(StatsStartDelay)
 	}
 	return buf
 }
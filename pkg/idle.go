@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// IdleState is the response of /sleep and /wake
+type IdleState struct {
+	Asleep bool `json:"asleep"`
+	// IdleTimeout is how long the display stays on after the last draw, 0
+	// if it never goes to sleep on its own
+	IdleTimeout string `json:"idleTimeout"`
+	// SleepsAt is when the display goes to sleep unless something is drawn
+	// before
+	SleepsAt *time.Time `json:"sleepsAt,omitempty"`
+}
+
+// idleTimer puts the display to sleep once nothing was drawn for a while
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	last    time.Time
+	asleep  bool
+}
+
+// init starts the timer, calling expired once the display was idle for
+// timeout. A timeout of 0 never expires.
+func (t *idleTimer) init(timeout time.Duration, expired func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeout = timeout
+	t.last = time.Now()
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, expired)
+	}
+}
+
+// touch records something drawn, starting the timeout over
+func (t *idleTimer) touch() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = time.Now()
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// due reports whether the display has been idle for the whole timeout
+func (t *idleTimer) due() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeout > 0 && time.Since(t.last) >= t.timeout
+}
+
+// lastDraw returns when something was last drawn
+func (t *idleTimer) lastDraw() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+func (t *idleTimer) isAsleep() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.asleep
+}
+
+// setAsleep records whether the display sleeps, returning what it was before
+func (t *idleTimer) setAsleep(asleep bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	was := t.asleep
+	t.asleep = asleep
+	return was
+}
+
+func (t *idleTimer) state() IdleState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := IdleState{Asleep: t.asleep, IdleTimeout: t.timeout.String()}
+	if t.timeout > 0 && !t.asleep {
+		at := t.last.Add(t.timeout)
+		s.SleepsAt = &at
+	}
+	return s
+}
+
+// Close stops the timer
+func (t *idleTimer) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// wakesDisplay reports whether a draw for source counts as activity. The
+// screens redrawn in the background would otherwise keep the display awake
+// forever.
+func wakesDisplay(source string) bool {
+	switch source {
+	case SourceStats, SourceCarousel, SourceInternal:
+		return false
+	}
+	return true
+}
+
+// wakeDisplay wakes the panel up if it is asleep. It runs on the render
+// queue's goroutine.
+func (b *PiboxFrameBuffer) wakeDisplay(fb *display.Display) error {
+	if !b.idle.setAsleep(false) {
+		return nil
+	}
+	if err := fb.Wake(b.config.backlightFade); err != nil {
+		b.idle.setAsleep(true)
+		return displayError(err)
+	}
+	return nil
+}
+
+// sleepDisplay puts the panel to sleep. Unless forced it only does so if
+// nothing was drawn for the idle timeout while the sleep waited in the queue.
+func (b *PiboxFrameBuffer) sleepDisplay(ctx context.Context, force bool) error {
+	return b.queue.Draw(ctx, PriorityNormal, false, func(fb *display.Display) error {
+		if b.idle.isAsleep() || (!force && !b.idle.due()) {
+			return nil
+		}
+		if err := fb.Sleep(b.config.backlightFade); err != nil {
+			return displayError(err)
+		}
+		b.idle.setAsleep(true)
+		return nil
+	})
+}
+
+// idleExpired puts the display to sleep once the idle timeout passed
+func (b *PiboxFrameBuffer) idleExpired() {
+	if err := b.sleepDisplay(context.Background(), false); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not put the display to sleep: %v\n", err)
+	}
+}
+
+// Sleep puts the display to sleep on POST or PUT until the next draw or a
+// request to /wake. GET reports whether it is asleep.
+func (b *PiboxFrameBuffer) Sleep(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		if err := b.sleepDisplay(req.Context(), true); err != nil {
+			writeError(w, err)
+			return
+		}
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, POST, PUT"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.idle.state())
+}
+
+// Wake wakes the display up on POST or PUT and starts the idle timeout over.
+// GET reports whether it is asleep.
+func (b *PiboxFrameBuffer) Wake(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		// redrawing for a request wakes the display and shows whatever
+		// changed while it slept
+		if err := b.redraw(req.Context(), PriorityHigh); err != nil {
+			writeError(w, err)
+			return
+		}
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, POST, PUT"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.idle.state())
+}
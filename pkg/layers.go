@@ -0,0 +1,465 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// Names of the built-in layers, from the bottom up
+const (
+	LayerBackground   = "background"
+	LayerApp          = "app"
+	LayerNotification = "notification"
+	LayerOverlay      = "overlay"
+)
+
+// layerZ is the z-order of the built-in layers. Other layers sit at the app
+// layer's z unless ?z= says otherwise.
+var layerZ = map[string]int{
+	LayerBackground:   0,
+	LayerCarousel:     50,
+	LayerApp:          100,
+	LayerNotification: 200,
+	LayerOverlay:      300,
+}
+
+// MaxLayers is how many layers other than the built-in ones there may be at
+// once. Each takes up a full screen of RGBA.
+const MaxLayers = 16
+
+var layerName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// LayerInfo describes a layer in the responses of /layers
+type LayerInfo struct {
+	Name      string     `json:"name"`
+	Z         int        `json:"z"`
+	Alpha     float64    `json:"alpha"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// layer is a screen sized image composited with the other layers
+type layer struct {
+	name  string
+	z     int
+	alpha float64
+	frame *image.RGBA
+
+	expires time.Time
+	timer   *time.Timer
+}
+
+func (l *layer) info() LayerInfo {
+	info := LayerInfo{Name: l.name, Z: l.z, Alpha: l.alpha}
+	if !l.expires.IsZero() {
+		expires := l.expires
+		info.ExpiresAt = &expires
+	}
+	return info
+}
+
+// layerOptions are the layer properties a request may change. nil fields
+// are left as they are.
+type layerOptions struct {
+	z     *int
+	alpha *float64
+	// timeout removes the layer that long from now, 0 keeps it forever
+	timeout *time.Duration
+}
+
+// parseLayerOptions reads ?z=, ?alpha= and ?timeout=
+func parseLayerOptions(query url.Values) (layerOptions, error) {
+	var opts layerOptions
+	if v := query.Get("z"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, badRequest("invalid_parameter", "z must be an integer", err)
+		}
+		opts.z = &z
+	}
+	if v := query.Get("alpha"); v != "" {
+		alpha, err := strconv.ParseFloat(v, 64)
+		if err != nil || alpha < 0 || alpha > 1 {
+			return opts, badRequest("invalid_parameter", "alpha must be between 0 and 1", err)
+		}
+		opts.alpha = &alpha
+	}
+	if v := query.Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return opts, badRequest("invalid_parameter", "timeout must be a duration like 30s or 5m", err)
+		}
+		opts.timeout = &timeout
+	}
+	return opts, nil
+}
+
+// queryLayer reads ?layer=, returning def if it is absent
+func queryLayer(query url.Values, def string) (string, error) {
+	name := query.Get("layer")
+	if name == "" {
+		return def, nil
+	}
+	if !layerName.MatchString(name) {
+		return "", invalidLayerName(name)
+	}
+	return name, nil
+}
+
+func invalidLayerName(name string) *Error {
+	return badRequest("invalid_layer", fmt.Sprintf("Invalid layer name %q, use up to 32 lower case letters, digits, - and _", name), nil)
+}
+
+func layerNotFound(name string) *Error {
+	return newError(http.StatusNotFound, "layer_not_found", fmt.Sprintf("There is no layer %q", name), nil)
+}
+
+func tooManyLayers() *Error {
+	return newError(http.StatusConflict, "too_many_layers", fmt.Sprintf("There are already %d layers besides the built-in ones, remove one first", MaxLayers), nil)
+}
+
+// layerStack holds the layers clients draw to. The screen shows all of them
+// composited over black in z-order.
+type layerStack struct {
+	size image.Point
+	// expired is called after a layer timed out and was removed
+	expired func(name string)
+
+	mu     sync.Mutex
+	layers map[string]*layer
+	// screen is reused by composite, which only the render queue calls
+	screen *image.RGBA
+}
+
+func newLayerStack(size image.Point, expired func(name string)) *layerStack {
+	return &layerStack{
+		size:    size,
+		expired: expired,
+		layers:  make(map[string]*layer),
+		screen:  image.NewRGBA(image.Rectangle{Max: size}),
+	}
+}
+
+// set creates or updates the layer name, applies opts and calls paint, if
+// given, with the layer's image. Creating a layer that is not built in fails
+// with a 409 once there are MaxLayers of them.
+func (s *layerStack) set(name string, opts layerOptions, paint func(frame *image.RGBA)) (LayerInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.layers[name]
+	if !ok {
+		z, ok := layerZ[name]
+		if !ok {
+			if s.customLocked() >= MaxLayers {
+				return LayerInfo{}, tooManyLayers()
+			}
+			z = layerZ[LayerApp]
+		}
+		l = &layer{
+			name:  name,
+			z:     z,
+			alpha: 1,
+			frame: image.NewRGBA(image.Rectangle{Max: s.size}),
+		}
+		s.layers[name] = l
+	}
+	if opts.z != nil {
+		l.z = *opts.z
+	}
+	if opts.alpha != nil {
+		l.alpha = *opts.alpha
+	}
+	if opts.timeout != nil {
+		s.expireLocked(l, *opts.timeout)
+	}
+	if paint != nil {
+		paint(l.frame)
+	}
+	return l.info(), nil
+}
+
+// customLocked counts the layers that are not built in
+func (s *layerStack) customLocked() int {
+	n := 0
+	for name := range s.layers {
+		if _, ok := layerZ[name]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// paint calls paint with the image of an existing layer, reporting whether
+// the layer exists
+func (s *layerStack) paint(name string, paint func(frame *image.RGBA)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.layers[name]
+	if ok {
+		paint(l.frame)
+	}
+	return ok
+}
+
+// update changes the properties of an existing layer, failing with a 404
+// when there is none
+func (s *layerStack) update(name string, opts layerOptions) (LayerInfo, error) {
+	s.mu.Lock()
+	_, ok := s.layers[name]
+	s.mu.Unlock()
+	if !ok {
+		return LayerInfo{}, layerNotFound(name)
+	}
+	return s.set(name, opts, nil)
+}
+
+func (s *layerStack) expireLocked(l *layer, timeout time.Duration) {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.expires = time.Time{}
+	if timeout == 0 {
+		return
+	}
+	l.expires = time.Now().Add(timeout)
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		// the layer may have been removed or given a new timeout since
+		current := s.layers[l.name] == l && l.timer == timer
+		if current {
+			delete(s.layers, l.name)
+		}
+		s.mu.Unlock()
+		if current && s.expired != nil {
+			s.expired(l.name)
+		}
+	})
+	l.timer = timer
+}
+
+// remove deletes the layer name, reporting whether it existed
+func (s *layerStack) remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.layers[name]
+	if !ok {
+		return false
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	delete(s.layers, name)
+	return true
+}
+
+// get returns a copy of the layer's image
+func (s *layerStack) get(name string) (*image.RGBA, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.layers[name]
+	if !ok {
+		return nil, false
+	}
+	frame := image.NewRGBA(l.frame.Rect)
+	copy(frame.Pix, l.frame.Pix)
+	return frame, true
+}
+
+// list returns the layers from the bottom up
+func (s *layerStack) list() []LayerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]LayerInfo, 0, len(s.layers))
+	for _, l := range s.sortedLocked() {
+		infos = append(infos, l.info())
+	}
+	return infos
+}
+
+func (s *layerStack) sortedLocked() []*layer {
+	layers := make([]*layer, 0, len(s.layers))
+	for _, l := range s.layers {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		if layers[i].z != layers[j].z {
+			return layers[i].z < layers[j].z
+		}
+		return layers[i].name < layers[j].name
+	})
+	return layers
+}
+
+// composite draws the layers over black. The returned image is reused by the
+// next call.
+func (s *layerStack) composite() *image.RGBA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	draw.Draw(s.screen, s.screen.Rect, image.Black, image.Point{}, draw.Src)
+	for _, l := range s.sortedLocked() {
+		switch {
+		case l.alpha <= 0:
+		case l.alpha >= 1:
+			draw.Draw(s.screen, s.screen.Rect, l.frame, image.Point{}, draw.Over)
+		default:
+			mask := &image.Uniform{color.Alpha{uint8(l.alpha*255 + 0.5)}}
+			draw.DrawMask(s.screen, s.screen.Rect, l.frame, image.Point{}, mask, image.Point{}, draw.Over)
+		}
+	}
+	return s.screen
+}
+
+// drawLayer updates a layer and draws the composited layers to the screen.
+// The layer is left alone when the render queue has no room for the draw.
+func (b *PiboxFrameBuffer) drawLayer(ctx context.Context, priority Priority, name string, opts layerOptions, paint func(frame *image.RGBA)) (LayerInfo, error) {
+	var info LayerInfo
+	err := b.redrawChange(ctx, priority, func() (err error) {
+		info, err = b.layers.set(name, opts, paint)
+		return err
+	})
+	return info, err
+}
+
+// redraw draws the composited layers to the screen
+func (b *PiboxFrameBuffer) redraw(ctx context.Context, priority Priority) error {
+	return b.redrawChange(ctx, priority, nil)
+}
+
+// redrawChange makes a change to the layers, if given, and draws them to the
+// screen. The change is only made once the render queue took the draw. Draws
+// for requests wake the display up, the ones made in the background wait
+// until it is awake.
+func (b *PiboxFrameBuffer) redrawChange(ctx context.Context, priority Priority, change func() error) error {
+	source := drawSource(ctx)
+	return b.queue.DrawChange(ctx, priority, true, change, func(fb *display.Display) error {
+		if wakesDisplay(source) {
+			b.idle.touch()
+			if err := b.wakeDisplay(fb); err != nil {
+				return err
+			}
+		} else if b.idle.isAsleep() {
+			return nil
+		}
+		if err := fb.DrawRAW(b.layers.composite()); err != nil {
+			return displayError(err)
+		}
+		counters.frameDrawn(source)
+		return nil
+	})
+}
+
+// layerExpired takes a timed out layer off the screen
+func (b *PiboxFrameBuffer) layerExpired(name string) {
+	b.player.StopOn(name)
+	if err := b.redraw(context.Background(), PriorityNormal); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not remove layer %s: %v\n", name, err)
+	}
+}
+
+// Layers lists the layers from the bottom up
+func (b *PiboxFrameBuffer) Layers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.layers.list())
+}
+
+// Layer manages the layer named in the path of /layers/{name}. GET returns
+// its image as a PNG, PUT or POST draws an image to it like /image does,
+// PATCH changes its z-order, alpha or timeout and DELETE removes it.
+func (b *PiboxFrameBuffer) Layer(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/layers/")
+	if !layerName.MatchString(name) {
+		writeError(w, invalidLayerName(name))
+		return
+	}
+	query := req.URL.Query()
+
+	var info LayerInfo
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		frame, ok := b.layers.get(name)
+		if !ok {
+			writeError(w, layerNotFound(name))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, frame)
+		return
+	case http.MethodPut, http.MethodPost:
+		var err error
+		info, err = b.drawImage(req, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	case http.MethodPatch:
+		opts, err := parseLayerOptions(query)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		priority, err := queryPriority(query)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		err = b.redrawChange(req.Context(), priority, func() (err error) {
+			info, err = b.layers.update(name, opts)
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	case http.MethodDelete:
+		priority, err := queryPriority(query)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		// no animation is stopped for a removal the queue would turn away
+		if err := b.queue.Check(priority, true); err != nil {
+			writeError(w, err)
+			return
+		}
+		b.player.StopOn(name)
+		err = b.redrawChange(req.Context(), priority, func() error {
+			if !b.layers.remove(name) {
+				return layerNotFound(name)
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, PUT, POST, PATCH, DELETE"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
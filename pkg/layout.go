@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit is how an image is sized to the screen
+type Fit string
+
+const (
+	FitContain Fit = "contain" // scale to fit inside the screen, keeping the aspect ratio
+	FitCover   Fit = "cover"   // scale to cover the whole screen, keeping the aspect ratio
+	FitStretch Fit = "stretch" // scale to the screen size, ignoring the aspect ratio
+	FitNone    Fit = "none"    // draw at the original size
+)
+
+// Align positions an image that does not exactly fill the screen, from 0
+// (left/top) to 1 (right/bottom)
+type Align struct {
+	X float64
+	Y float64
+}
+
+var AlignCenter = Align{X: 0.5, Y: 0.5}
+
+var filters = map[string]draw.Interpolator{
+	"nearest":    draw.NearestNeighbor,
+	"bilinear":   draw.BiLinear,
+	"catmullrom": draw.CatmullRom,
+}
+
+// Layout describes how an image of any size is drawn to the screen
+type Layout struct {
+	Fit        Fit
+	Align      Align
+	Background color.RGBA
+	Filter     draw.Interpolator
+}
+
+// DefaultLayout scales images to fit the screen and centres them on black
+var DefaultLayout = Layout{
+	Fit:        FitContain,
+	Align:      AlignCenter,
+	Background: color.RGBA{A: 255},
+	Filter:     draw.BiLinear,
+}
+
+// parseAlign parses "center" or a position such as "top", "bottom-right"
+// or "left"
+func parseAlign(s string) (Align, error) {
+	a := AlignCenter
+	if s == "" || s == "center" {
+		return a, nil
+	}
+	for _, part := range strings.Split(s, "-") {
+		switch part {
+		case "top":
+			a.Y = 0
+		case "bottom":
+			a.Y = 1
+		case "left":
+			a.X = 0
+		case "right":
+			a.X = 1
+		case "center":
+		default:
+			return a, fmt.Errorf("unknown alignment %q", s)
+		}
+	}
+	return a, nil
+}
+
+// parseLayout reads ?fit=, ?align=, ?background= and ?filter=, falling back
+// to DefaultLayout
+func parseLayout(query url.Values) (Layout, error) {
+	l := DefaultLayout
+	if fit := query.Get("fit"); fit != "" {
+		switch Fit(fit) {
+		case FitContain, FitCover, FitStretch, FitNone:
+			l.Fit = Fit(fit)
+		default:
+			return l, badRequest("invalid_parameter", "fit must be contain, cover, stretch or none", nil)
+		}
+	}
+	align, err := parseAlign(query.Get("align"))
+	if err != nil {
+		return l, badRequest("invalid_parameter", "align must be center or a combination of top, bottom, left and right", err)
+	}
+	l.Align = align
+	if bg := query.Get("background"); bg != "" {
+		c, err := parseHexColor(bg)
+		if err != nil {
+			return l, badRequest("invalid_parameter", "background must be a hex colour", err)
+		}
+		l.Background = c
+	}
+	if name := query.Get("filter"); name != "" {
+		filter, ok := filters[name]
+		if !ok {
+			return l, badRequest("invalid_parameter", "filter must be nearest, bilinear or catmullrom", nil)
+		}
+		l.Filter = filter
+	}
+	return l, nil
+}
+
+// Render draws src onto a new image of the given size
+func (l Layout) Render(src image.Image, size image.Point) *image.RGBA {
+	dst := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(dst, dst.Rect, &image.Uniform{l.Background}, image.Point{}, draw.Src)
+
+	sr := src.Bounds()
+	if sr.Empty() {
+		return dst
+	}
+	w, h := float64(sr.Dx()), float64(sr.Dy())
+	scaleX, scaleY := float64(size.X)/w, float64(size.Y)/h
+	switch l.Fit {
+	case FitContain:
+		scaleX = math.Min(scaleX, scaleY)
+		scaleY = scaleX
+	case FitCover:
+		scaleX = math.Max(scaleX, scaleY)
+		scaleY = scaleX
+	case FitNone:
+		scaleX, scaleY = 1, 1
+	}
+
+	tw, th := int(math.Round(w*scaleX)), int(math.Round(h*scaleY))
+	x := int(math.Round(float64(size.X-tw) * l.Align.X))
+	y := int(math.Round(float64(size.Y-th) * l.Align.Y))
+	target := image.Rect(x, y, x+tw, y+th)
+
+	if tw == sr.Dx() && th == sr.Dy() {
+		draw.Draw(dst, target, src, sr.Min, draw.Over)
+	} else {
+		l.Filter.Scale(dst, target, src, sr, draw.Over, nil)
+	}
+	return dst
+}
+
+// MaxImageSize is the largest image a request may send, in its body or in a
+// scene as base64
+const MaxImageSize = 8 << 20
+
+// decodeImage decodes a PNG, JPEG or GIF of at most maxSide pixels a side and
+// MaxAnimationPixels in all. The size is read from the image's header before
+// any pixels are decoded.
+func decodeImage(data []byte, maxSide int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > maxSide || config.Height > maxSide || config.Width*config.Height > MaxAnimationPixels {
+		return nil, fmt.Errorf("image of %dx%d is too large, at most %dx%d and %d pixels are supported", config.Width, config.Height, maxSide, maxSide, MaxAnimationPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
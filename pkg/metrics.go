@@ -0,0 +1,277 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+	"github.com/kubesail/pibox-framebuffer/metrics"
+)
+
+// Sources of the frames drawn in the background, reported by /metrics next
+// to the endpoints frames are drawn for
+const (
+	SourceAnimation    = "animation"
+	SourceCarousel     = "carousel"
+	SourceNotification = "notification"
+	SourceStats        = "stats"
+	// SourceSchedule is the display coming back at the end of quiet hours
+	SourceSchedule = "schedule"
+	// SourceInternal is anything else, like the splash screen or a layer
+	// that expired
+	SourceInternal = "internal"
+)
+
+type sourceKey struct{}
+
+// withSource marks the draws made with ctx as drawn for source
+func withSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// drawSource returns what the draws made with ctx are drawn for
+func drawSource(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey{}).(string); ok {
+		return source
+	}
+	return SourceInternal
+}
+
+type requestKey struct {
+	endpoint string
+	status   int
+}
+
+// daemonCounters counts what the server did since it started
+type daemonCounters struct {
+	mu        sync.Mutex
+	frames    map[string]uint64
+	requests  map[requestKey]uint64
+	durations map[string]*metrics.Histogram
+	errors    map[string]uint64
+}
+
+var counters = &daemonCounters{
+	frames:    make(map[string]uint64),
+	requests:  make(map[requestKey]uint64),
+	durations: make(map[string]*metrics.Histogram),
+	errors:    make(map[string]uint64),
+}
+
+// frameDrawn counts a frame sent to the display for source
+func (c *daemonCounters) frameDrawn(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames[source]++
+}
+
+// request counts a request to endpoint and how long it took
+func (c *daemonCounters) request(endpoint string, status int, took time.Duration) {
+	c.mu.Lock()
+	c.requests[requestKey{endpoint, status}]++
+	h, ok := c.durations[endpoint]
+	if !ok {
+		h = metrics.NewHistogram(metrics.DefaultLatencyBuckets)
+		c.durations[endpoint] = h
+	}
+	c.mu.Unlock()
+	h.ObserveDuration(took)
+}
+
+// error counts an error written to a client by its code
+func (c *daemonCounters) error(code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[code]++
+}
+
+// countersSnapshot is a copy of the counters, written out without holding up
+// the draws that count frames
+type countersSnapshot struct {
+	frames    map[string]uint64
+	requests  map[requestKey]uint64
+	durations map[string]metrics.HistogramSnapshot
+	errors    map[string]uint64
+}
+
+func (c *daemonCounters) snapshot() countersSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := countersSnapshot{
+		frames:    make(map[string]uint64, len(c.frames)),
+		requests:  make(map[requestKey]uint64, len(c.requests)),
+		durations: make(map[string]metrics.HistogramSnapshot, len(c.durations)),
+		errors:    make(map[string]uint64, len(c.errors)),
+	}
+	for k, v := range c.frames {
+		s.frames[k] = v
+	}
+	for k, v := range c.requests {
+		s.requests[k] = v
+	}
+	for k, h := range c.durations {
+		s.durations[k] = h.Snapshot()
+	}
+	for k, v := range c.errors {
+		s.errors[k] = v
+	}
+	return s
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Instrument counts the requests handled by h and how long they took, and
+// counts the frames they draw under endpoint
+func (b *PiboxFrameBuffer) Instrument(endpoint string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, req.WithContext(withSource(req.Context(), endpoint)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		counters.request(endpoint, rec.status, time.Since(start))
+	})
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolGauge(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Metrics reports the server's metrics in the Prometheus text format
+func (b *PiboxFrameBuffer) Metrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	m := metrics.NewWriter(w)
+
+	fb, err := display.Init()
+	m.Family("pibox_display_up", metrics.TypeGauge, "Whether the display was opened")
+	m.Sample("pibox_display_up", boolGauge(err == nil))
+	var s display.Stats
+	if err == nil {
+		backend := display.BackendSPI
+		if _, ok := fb.Backend().(*display.Memory); ok {
+			backend = display.BackendMemory
+		}
+		m.Family("pibox_display_info", metrics.TypeGauge, "The display backend in use")
+		m.Sample("pibox_display_info", 1, metrics.Label{Name: "backend", Value: backend})
+		m.Family("pibox_backlight_on", metrics.TypeGauge, "Whether the backlight is on")
+		m.Sample("pibox_backlight_on", boolGauge(fb.Powered()))
+		m.Family("pibox_display_asleep", metrics.TypeGauge, "Whether the display was put to sleep")
+		m.Sample("pibox_display_asleep", boolGauge(b.idle.isAsleep()))
+		m.Family("pibox_backlight_brightness", metrics.TypeGauge, "Brightness of the backlight from 0 to 100")
+		m.Sample("pibox_backlight_brightness", float64(fb.Backlight().Level()))
+		s = fb.Stats()
+	}
+	m.Family("pibox_quiet_hours_active", metrics.TypeGauge, "Whether quiet hours are in effect")
+	m.Sample("pibox_quiet_hours_active", boolGauge(b.quiet.paused()))
+
+	m.Family("pibox_display_frames_total", metrics.TypeCounter, "Full frames sent to the display")
+	m.Sample("pibox_display_frames_total", float64(s.Frames))
+	m.Family("pibox_display_regions_total", metrics.TypeCounter, "Address windows written to the display")
+	m.Sample("pibox_display_regions_total", float64(s.Regions))
+	m.Family("pibox_spi_bytes_sent_total", metrics.TypeCounter, "Pixel bytes sent over SPI")
+	m.Sample("pibox_spi_bytes_sent_total", float64(s.BytesSent))
+	m.Family("pibox_spi_bytes_saved_total", metrics.TypeCounter, "Pixel bytes not sent because the display already showed them")
+	m.Sample("pibox_spi_bytes_saved_total", float64(s.BytesSaved))
+	m.Family("pibox_spi_transfers_total", metrics.TypeCounter, "SPI transfers made")
+	m.Sample("pibox_spi_transfers_total", float64(s.Transfers))
+	m.Family("pibox_spi_transfer_errors_total", metrics.TypeCounter, "SPI transfers that failed")
+	m.Sample("pibox_spi_transfer_errors_total", float64(s.TransferErrors))
+	m.Family("pibox_frame_convert_seconds", metrics.TypeHistogram, "Time spent converting frames to the display's pixel format")
+	m.Histogram("pibox_frame_convert_seconds", s.Convert)
+	m.Family("pibox_frame_transfer_seconds", metrics.TypeHistogram, "Time spent sending frames to the display")
+	m.Histogram("pibox_frame_transfer_seconds", s.Transfer)
+
+	m.Family("pibox_render_queue_depth", metrics.TypeGauge, "Draws waiting for the display")
+	m.Sample("pibox_render_queue_depth", float64(b.queue.Len()))
+	m.Family("pibox_render_queue_capacity", metrics.TypeGauge, "Draws that may wait for the display before requests are turned away")
+	m.Sample("pibox_render_queue_capacity", float64(b.config.queueSize))
+	m.Family("pibox_render_queue_coalesced_total", metrics.TypeCounter, "Draws dropped because a newer frame replaced them")
+	m.Sample("pibox_render_queue_coalesced_total", float64(b.queue.Coalesced()))
+
+	f := fonts.faces.Stats()
+	m.Family("pibox_font_faces", metrics.TypeGauge, "Font faces in the cache")
+	m.Sample("pibox_font_faces", float64(f.Faces))
+	m.Family("pibox_font_cache_hits_total", metrics.TypeCounter, "Text drawn with a cached font face")
+	m.Sample("pibox_font_cache_hits_total", float64(f.Hits))
+	m.Family("pibox_font_cache_misses_total", metrics.TypeCounter, "Font faces created because none was cached")
+	m.Sample("pibox_font_cache_misses_total", float64(f.Misses))
+
+	c := counters.snapshot()
+	m.Family("pibox_frames_drawn_total", metrics.TypeCounter, "Frames drawn by endpoint, or by the background job that drew them")
+	for _, source := range sortedKeys(c.frames) {
+		m.Sample("pibox_frames_drawn_total", float64(c.frames[source]), metrics.Label{Name: "source", Value: source})
+	}
+
+	requests := make([]requestKey, 0, len(c.requests))
+	for k := range c.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].endpoint != requests[j].endpoint {
+			return requests[i].endpoint < requests[j].endpoint
+		}
+		return requests[i].status < requests[j].status
+	})
+	m.Family("pibox_http_requests_total", metrics.TypeCounter, "HTTP requests by endpoint and status code")
+	for _, k := range requests {
+		m.Sample("pibox_http_requests_total", float64(c.requests[k]),
+			metrics.Label{Name: "endpoint", Value: k.endpoint}, metrics.Label{Name: "code", Value: strconv.Itoa(k.status)})
+	}
+	endpoints := make([]string, 0, len(c.durations))
+	for endpoint := range c.durations {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	m.Family("pibox_http_request_duration_seconds", metrics.TypeHistogram, "Time spent handling HTTP requests by endpoint")
+	for _, endpoint := range endpoints {
+		m.Histogram("pibox_http_request_duration_seconds", c.durations[endpoint], metrics.Label{Name: "endpoint", Value: endpoint})
+	}
+
+	m.Family("pibox_errors_total", metrics.TypeCounter, "Errors returned to clients by error code")
+	for _, code := range sortedKeys(c.errors) {
+		m.Sample("pibox_errors_total", float64(c.errors[code]), metrics.Label{Name: "code", Value: code})
+	}
+	m.Family("pibox_decode_failures_total", metrics.TypeCounter, "Images and animations that could not be decoded")
+	m.Sample("pibox_decode_failures_total", float64(c.errors["invalid_image"]))
+
+	m.Flush()
+}
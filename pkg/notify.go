@@ -0,0 +1,466 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// MaxNotifications is how many notifications may wait to be shown
+const MaxNotifications = 16
+
+// DefaultNotificationDuration is how long a notification is shown unless it
+// says otherwise
+const DefaultNotificationDuration = 5 * time.Second
+
+// MaxNotificationDuration is the longest a notification may be shown
+const MaxNotificationDuration = time.Hour
+
+// Severities of a notification, which pick its accent colour and icon
+const (
+	SeverityInfo    = "info"
+	SeveritySuccess = "success"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+var severityColors = map[string]color.RGBA{
+	SeverityInfo:    {66, 153, 225, 255},
+	SeveritySuccess: {72, 187, 120, 255},
+	SeverityWarning: {236, 177, 52, 255},
+	SeverityError:   {229, 62, 62, 255},
+}
+
+// Notification is a message shown over the screen for a while, the body of
+// a POST to /notify
+type Notification struct {
+	ID       uint64 `json:"id"`
+	Title    string `json:"title"`
+	Message  string `json:"message,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	// Icon is info, success, warning, error or none, and defaults to the
+	// severity
+	Icon       string `json:"icon,omitempty"`
+	Background string `json:"background,omitempty"`
+	Color      string `json:"color,omitempty"`
+	// Position is top, center or bottom
+	Position string `json:"position,omitempty"`
+	Duration string `json:"duration,omitempty"`
+
+	duration time.Duration
+	priority Priority
+}
+
+// validate fills in the defaults and checks the notification can be drawn
+func (n *Notification) validate() error {
+	if n.Title == "" && n.Message == "" {
+		return badRequest("missing_parameter", "A notification needs a title or a message", nil)
+	}
+	if n.Severity == "" {
+		n.Severity = SeverityInfo
+	}
+	if _, ok := severityColors[n.Severity]; !ok {
+		return badRequest("invalid_parameter", fmt.Sprintf("Unknown severity %q, use info, success, warning or error", n.Severity), nil)
+	}
+	if n.Icon == "" {
+		n.Icon = n.Severity
+	}
+	if _, ok := severityColors[n.Icon]; !ok && n.Icon != "none" {
+		return badRequest("invalid_parameter", fmt.Sprintf("Unknown icon %q, use info, success, warning, error or none", n.Icon), nil)
+	}
+	if n.Background == "" {
+		n.Background = "222222"
+	}
+	if n.Color == "" {
+		n.Color = "ffffff"
+	}
+	for _, c := range []string{n.Background, n.Color} {
+		if _, err := parseHexColor(c); err != nil {
+			return badRequest("invalid_parameter", "Colours must be hex, like ff0000", err)
+		}
+	}
+	switch n.Position {
+	case "":
+		n.Position = "top"
+	case "top", "center", "bottom":
+	default:
+		return badRequest("invalid_parameter", fmt.Sprintf("Unknown position %q, use top, center or bottom", n.Position), nil)
+	}
+	n.duration = DefaultNotificationDuration
+	if n.Duration != "" {
+		d, err := time.ParseDuration(n.Duration)
+		if err != nil || d <= 0 || d > MaxNotificationDuration {
+			return badRequest("invalid_parameter", "duration must be a duration up to 1h, like 5s", err)
+		}
+		n.duration = d
+	}
+	n.Duration = n.duration.String()
+	return nil
+}
+
+// render draws the notification as a card on an otherwise transparent image
+func (n *Notification) render(size int) (image.Image, error) {
+	const (
+		margin  = 8.0
+		padding = 12.0
+		icon    = 28.0
+		gap     = 10.0
+		stripe  = 5.0
+	)
+	background, _ := parseHexColor(n.Background)
+	foreground, _ := parseHexColor(n.Color)
+	accent := severityColors[n.Severity]
+
+	dc := gg.NewContext(size, size)
+	width := float64(size) - 2*margin
+	textX := margin + stripe + padding
+	if n.Icon != "none" {
+		textX += icon + gap
+	}
+	textWidth := margin + width - padding - textX
+
+	// measure the wrapped text to size the card
+	var title, message []string
+	height := 0.0
+	if n.Title != "" {
+		if err := loadFont(dc, 20, true); err != nil {
+			return nil, err
+		}
+		title = dc.WordWrap(n.Title, textWidth)
+		height += float64(len(title)) * dc.FontHeight() * 1.3
+	}
+	if n.Message != "" {
+		if err := loadFont(dc, 16, false); err != nil {
+			return nil, err
+		}
+		message = dc.WordWrap(n.Message, textWidth)
+		height += float64(len(message)) * dc.FontHeight() * 1.3
+	}
+	height = math.Min(math.Max(height, icon), float64(size)-2*margin-2*padding) + 2*padding
+
+	y := margin
+	switch n.Position {
+	case "center":
+		y = (float64(size) - height) / 2
+	case "bottom":
+		y = float64(size) - margin - height
+	}
+
+	dc.DrawRoundedRectangle(margin, y, width, height, 8)
+	dc.SetColor(background)
+	dc.Fill()
+	dc.DrawRoundedRectangle(margin, y, stripe+4, height, 4)
+	dc.SetColor(accent)
+	dc.Fill()
+	// square off the inner edge of the stripe
+	dc.DrawRectangle(margin+stripe, y, 4, height)
+	dc.SetColor(background)
+	dc.Fill()
+
+	if n.Icon != "none" {
+		drawIcon(dc, n.Icon, margin+stripe+padding, y+padding, icon)
+	}
+
+	// clip so overly long messages stay inside the card
+	dc.DrawRectangle(margin, y+padding, width, height-2*padding)
+	dc.Clip()
+	dc.SetColor(foreground)
+	textY := y + padding
+	if len(title) > 0 {
+		loadFont(dc, 20, true)
+		for _, line := range title {
+			textY += dc.FontHeight() * 1.3
+			dc.DrawString(line, textX, textY-dc.FontHeight()*0.3)
+		}
+	}
+	if len(message) > 0 {
+		loadFont(dc, 16, false)
+		for _, line := range message {
+			textY += dc.FontHeight() * 1.3
+			dc.DrawString(line, textX, textY-dc.FontHeight()*0.3)
+		}
+	}
+	dc.ResetClip()
+	return dc.Image(), nil
+}
+
+// drawIcon draws one of the notification icons in a size by size square
+func drawIcon(dc *gg.Context, name string, x, y, size float64) {
+	cx, cy, r := x+size/2, y+size/2, size/2
+	dc.SetColor(severityColors[name])
+	if name == SeverityWarning {
+		dc.MoveTo(cx, y)
+		dc.LineTo(x+size, y+size)
+		dc.LineTo(x, y+size)
+		dc.ClosePath()
+	} else {
+		dc.DrawCircle(cx, cy, r)
+	}
+	dc.Fill()
+
+	dc.SetColor(color.White)
+	dc.SetLineWidth(3)
+	dc.SetLineCapRound()
+	switch name {
+	case SeverityInfo:
+		dc.DrawCircle(cx, cy-r*0.45, 2)
+		dc.Fill()
+		dc.DrawLine(cx, cy-r*0.1, cx, cy+r*0.5)
+	case SeveritySuccess:
+		dc.MoveTo(cx-r*0.45, cy)
+		dc.LineTo(cx-r*0.1, cy+r*0.35)
+		dc.LineTo(cx+r*0.45, cy-r*0.3)
+	case SeverityWarning:
+		dc.DrawLine(cx, cy-r*0.2, cx, cy+r*0.35)
+		dc.Stroke()
+		dc.DrawCircle(cx, cy+r*0.7, 2)
+		dc.Fill()
+		return
+	case SeverityError:
+		dc.DrawLine(cx-r*0.4, cy-r*0.4, cx+r*0.4, cy+r*0.4)
+		dc.Stroke()
+		dc.DrawLine(cx+r*0.4, cy-r*0.4, cx-r*0.4, cy+r*0.4)
+	}
+	dc.Stroke()
+}
+
+// notifier shows notifications one after the other on the notification
+// layer, and removes the layer once they have all been shown so whatever was
+// on the screen before comes back
+type notifier struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*Notification
+	current *Notification
+	nextID  uint64
+	// dismiss ends the current notification early
+	dismiss chan struct{}
+	closed  bool
+	stopped chan struct{}
+}
+
+func (n *notifier) init() {
+	n.cond = sync.NewCond(&n.mu)
+	n.dismiss = make(chan struct{}, 1)
+	n.stopped = make(chan struct{})
+}
+
+// Push queues a notification, returning how many are ahead of it
+func (n *notifier) Push(note *Notification) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return 0, queueClosed()
+	}
+	if len(n.queue) >= MaxNotifications {
+		e := newError(http.StatusTooManyRequests, "notifications_full", "Too many notifications are waiting, try again later", nil)
+		e.RetryAfter = 1
+		return 0, e
+	}
+	n.nextID++
+	note.ID = n.nextID
+	n.queue = append(n.queue, note)
+	n.cond.Signal()
+	ahead := len(n.queue) - 1
+	if n.current != nil {
+		ahead++
+	}
+	return ahead, nil
+}
+
+// next waits for the next notification. It returns nil once closed.
+func (n *notifier) next() *Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.current = nil
+	for len(n.queue) == 0 && !n.closed {
+		n.cond.Wait()
+	}
+	if n.closed {
+		return nil
+	}
+	n.current = n.queue[0]
+	n.queue[0] = nil
+	n.queue = n.queue[1:]
+	// a dismiss sent between notifications is meant for the one before
+	select {
+	case <-n.dismiss:
+	default:
+	}
+	return n.current
+}
+
+// pending reports whether more notifications are waiting
+func (n *notifier) pending() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.queue) > 0
+}
+
+// Dismiss ends the current notification early, and with all also drops the
+// waiting ones
+func (n *notifier) Dismiss(all bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if all {
+		for i := range n.queue {
+			n.queue[i] = nil
+		}
+		n.queue = n.queue[:0]
+	}
+	if n.current != nil {
+		select {
+		case n.dismiss <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// List returns the notification being shown, if any, and the waiting ones
+func (n *notifier) List() (*Notification, []*Notification) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	queue := make([]*Notification, len(n.queue))
+	copy(queue, n.queue)
+	return n.current, queue
+}
+
+// Close drops the waiting notifications and stops showing them
+func (n *notifier) Close() {
+	n.mu.Lock()
+	n.closed = true
+	n.queue = nil
+	n.cond.Broadcast()
+	select {
+	case n.dismiss <- struct{}{}:
+	default:
+	}
+	n.mu.Unlock()
+	<-n.stopped
+}
+
+// showNotifications runs until the notifier is closed
+func (b *PiboxFrameBuffer) showNotifications() {
+	defer close(b.notifier.stopped)
+	for {
+		note := b.notifier.next()
+		if note == nil {
+			return
+		}
+		if err := b.showNotification(note); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not show notification %d: %v\n", note.ID, err)
+		} else {
+			timer := time.NewTimer(note.duration)
+			select {
+			case <-timer.C:
+			case <-b.notifier.dismiss:
+				timer.Stop()
+			}
+		}
+		if b.notifier.pending() {
+			// draw the next one straight over this one
+			continue
+		}
+		if b.layers.remove(LayerNotification) {
+			if err := b.redraw(withSource(context.Background(), SourceNotification), note.priority); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not remove notification %d: %v\n", note.ID, err)
+			}
+		}
+	}
+}
+
+func (b *PiboxFrameBuffer) showNotification(note *Notification) error {
+	card, err := note.render(b.config.screenSize)
+	if err != nil {
+		return err
+	}
+	b.player.StopOn(LayerNotification)
+	_, err = b.drawLayer(withSource(context.Background(), SourceNotification), note.priority, LayerNotification, layerOptions{}, func(frame *image.RGBA) {
+		draw.Draw(frame, frame.Rect, card, image.Point{}, draw.Src)
+	})
+	return err
+}
+
+// NotifyResponse is the response of a POST to /notify
+type NotifyResponse struct {
+	ID uint64 `json:"id"`
+	// Ahead is how many notifications are shown before this one
+	Ahead int `json:"ahead"`
+}
+
+// NotificationsResponse is the response of a GET of /notify
+type NotificationsResponse struct {
+	Current *Notification   `json:"current"`
+	Queued  []*Notification `json:"queued"`
+}
+
+// Notify shows a notification over the screen for a while, then brings back
+// whatever was there before. A POST queues the JSON notification in its body,
+// GET lists the notifications and DELETE dismisses the current one, or all of
+// them with ?all=true. Warnings and errors are drawn at high priority unless
+// ?priority= says otherwise.
+func (b *PiboxFrameBuffer) Notify(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		current, queued := b.notifier.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NotificationsResponse{Current: current, Queued: queued})
+		return
+	case http.MethodDelete:
+		all := strings.EqualFold(req.URL.Query().Get("all"), "true")
+		b.notifier.Dismiss(all)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, methodNotAllowed(w, "GET, HEAD, POST, DELETE"))
+		return
+	}
+
+	var note Notification
+	if err := json.NewDecoder(req.Body).Decode(&note); err != nil {
+		writeError(w, badRequest("invalid_json", "Send a JSON notification with a title and a message", err))
+		return
+	}
+	if err := note.validate(); err != nil {
+		writeError(w, err)
+		return
+	}
+	note.priority = PriorityNormal
+	if note.Severity == SeverityWarning || note.Severity == SeverityError {
+		note.priority = PriorityHigh
+	}
+	if req.URL.Query().Get("priority") != "" {
+		priority, err := queryPriority(req.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		note.priority = priority
+	}
+	// fail now rather than when the notification comes up
+	if _, err := note.render(b.config.screenSize); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ahead, err := b.notifier.Push(&note)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(NotifyResponse{ID: note.ID, Ahead: ahead})
+}
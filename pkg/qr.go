@@ -0,0 +1,287 @@
+package pkg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fogleman/gg"
+	"github.com/skip2/go-qrcode"
+)
+
+// DefaultQRQuietZone is the margin around a QR code in modules. The standard
+// asks for 4, but most readers cope with less and the screen is small.
+const DefaultQRQuietZone = 2
+
+// MaxQRLogoSize is the largest share of a QR code's width a logo may cover
+const MaxQRLogoSize = 0.3
+
+// MaxQRLogoBytes and MaxQRLogoSide bound the logo sent in the body of /qr.
+// It only ever covers part of the screen.
+const (
+	MaxQRLogoBytes = 2 << 20
+	MaxQRLogoSide  = 4 * DefaultScreenSize
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"low":     qrcode.Low,
+	"medium":  qrcode.Medium,
+	"high":    qrcode.High,
+	"highest": qrcode.Highest,
+}
+
+// qrOptions describe how a QR code is drawn
+type qrOptions struct {
+	content string
+	level   qrcode.RecoveryLevel
+	fg, bg  color.RGBA
+	// moduleSize is the size of a module in pixels, 0 picks the largest
+	// that fits size
+	moduleSize int
+	size       int
+	quietZone  int
+
+	caption      string
+	captionSize  float64
+	captionColor color.RGBA
+	font         string
+
+	// logo is drawn over the middle of the code, logoSize wide as a share
+	// of the code's width
+	logo     image.Image
+	logoSize float64
+}
+
+// parseQROptions reads ?content=, ?level=, ?color=, ?background=,
+// ?moduleSize=, ?size=, ?quietZone=, ?caption=, ?captionSize=,
+// ?captionColor=, ?font= and ?logoSize=
+func parseQROptions(query url.Values) (qrOptions, error) {
+	o := qrOptions{
+		content:     query.Get("content"),
+		level:       qrcode.Medium,
+		fg:          color.RGBA{A: 255},
+		bg:          color.RGBA{255, 255, 255, 255},
+		quietZone:   DefaultQRQuietZone,
+		caption:     query.Get("caption"),
+		captionSize: 16,
+		logoSize:    0.2,
+	}
+	if o.content == "" {
+		return o, badRequest("missing_parameter", "Pass ?content= to render a QR code", nil)
+	}
+	if v := query.Get("level"); v != "" {
+		level, ok := qrLevels[v]
+		if !ok {
+			return o, badRequest("invalid_parameter", "level must be low, medium, high or highest", nil)
+		}
+		o.level = level
+	}
+	var err error
+	if v := query.Get("color"); v != "" {
+		if o.fg, err = parseHexColor(v); err != nil {
+			return o, badRequest("invalid_parameter", "color must be a hex colour", err)
+		}
+	}
+	if v := query.Get("background"); v != "" {
+		if o.bg, err = parseHexColor(v); err != nil {
+			return o, badRequest("invalid_parameter", "background must be a hex colour", err)
+		}
+	}
+	o.captionColor = o.fg
+	if v := query.Get("captionColor"); v != "" {
+		if o.captionColor, err = parseHexColor(v); err != nil {
+			return o, badRequest("invalid_parameter", "captionColor must be a hex colour", err)
+		}
+	}
+	if o.moduleSize, err = queryInt(query, "moduleSize", 0); err != nil {
+		return o, err
+	}
+	if o.size, err = queryInt(query, "size", 0); err != nil {
+		return o, err
+	}
+	if o.quietZone, err = queryInt(query, "quietZone", o.quietZone); err != nil {
+		return o, err
+	}
+	if o.moduleSize < 0 || o.size < 0 || o.quietZone < 0 {
+		return o, badRequest("invalid_parameter", "moduleSize, size and quietZone may not be negative", nil)
+	}
+	if o.moduleSize > DefaultScreenSize || o.quietZone > DefaultScreenSize {
+		// larger ones never fit on the screen, and could overflow working
+		// out whether they do
+		return o, badRequest("invalid_parameter", fmt.Sprintf("moduleSize and quietZone may be at most %d", DefaultScreenSize), nil)
+	}
+	if v := query.Get("captionSize"); v != "" {
+		o.captionSize, err = strconv.ParseFloat(v, 64)
+		if err != nil || o.captionSize <= 0 || o.captionSize > MaxTextSize {
+			return o, badRequest("invalid_parameter", fmt.Sprintf("captionSize must be a positive number up to %d", MaxTextSize), err)
+		}
+	}
+	if family := query.Get("font"); family != "" {
+		if !fonts.has(family) {
+			return o, unknownFont(family)
+		}
+		o.font = family
+	}
+	if v := query.Get("logoSize"); v != "" {
+		o.logoSize, err = strconv.ParseFloat(v, 64)
+		if err != nil || o.logoSize <= 0 || o.logoSize > MaxQRLogoSize {
+			return o, badRequest("invalid_parameter", fmt.Sprintf("logoSize must be above 0 and at most %v", MaxQRLogoSize), err)
+		}
+	}
+	return o, nil
+}
+
+// code draws the QR code with its quiet zone, at most max pixels wide
+// unless the module size is fixed
+func (o qrOptions) code(max int) (*image.RGBA, error) {
+	q, err := qrcode.New(o.content, o.level)
+	if err != nil {
+		return nil, badRequest("invalid_qr_content", "Could not encode QR code", err)
+	}
+	q.DisableBorder = true
+	bitmap := q.Bitmap()
+	modules := len(bitmap) + 2*o.quietZone
+
+	moduleSize := o.moduleSize
+	if moduleSize == 0 {
+		target := max
+		if o.size > 0 && o.size < max {
+			target = o.size
+		}
+		moduleSize = target / modules
+	}
+	if moduleSize < 1 || modules*moduleSize > max {
+		return nil, badRequest("qr_too_large", fmt.Sprintf("A QR code of %d modules does not fit in %dpx, shorten the content or lower the level", modules, max), nil)
+	}
+
+	side := modules * moduleSize
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(img, img.Rect, &image.Uniform{o.bg}, image.Point{}, draw.Src)
+	fg := &image.Uniform{o.fg}
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			px, py := (x+o.quietZone)*moduleSize, (y+o.quietZone)*moduleSize
+			draw.Draw(img, image.Rect(px, py, px+moduleSize, py+moduleSize), fg, image.Point{}, draw.Src)
+		}
+	}
+
+	if o.logo != nil {
+		// the logo sits on a square of the background colour, which the
+		// error correction has to make up for
+		codeSide := len(bitmap) * moduleSize
+		box := int(float64(codeSide) * o.logoSize)
+		pad := moduleSize
+		at := (side - box) / 2
+		draw.Draw(img, image.Rect(at-pad, at-pad, at+box+pad, at+box+pad), &image.Uniform{o.bg}, image.Point{}, draw.Src)
+		layout := DefaultLayout
+		layout.Background = o.bg
+		logo := layout.Render(o.logo, image.Pt(box, box))
+		draw.Draw(img, image.Rect(at, at, at+box, at+box), logo, image.Point{}, draw.Over)
+	}
+	return img, nil
+}
+
+// render draws the QR code and its caption centred on the background
+func (o qrOptions) render(screen int) (*image.RGBA, error) {
+	dc := gg.NewContext(screen, screen)
+	dc.SetColor(o.bg)
+	dc.Clear()
+
+	captionHeight := 0.0
+	if o.caption != "" {
+		if err := setFont(dc, o.font, WeightRegular, o.captionSize); err != nil {
+			return nil, err
+		}
+		lines := dc.WordWrap(o.caption, float64(screen-16))
+		captionHeight = textHeight(dc, len(lines), 1.2) + 8
+	}
+
+	code, err := o.code(screen - int(math.Ceil(captionHeight)))
+	if err != nil {
+		return nil, err
+	}
+	side := code.Rect.Dx()
+	top := (screen - side - int(captionHeight)) / 2
+	dc.DrawImage(code, (screen-side)/2, top)
+	if o.caption != "" {
+		dc.SetColor(o.captionColor)
+		dc.DrawStringWrapped(o.caption, 8, float64(top+side)+8, 0, 0, float64(screen-16), 1.2, gg.AlignCenter)
+	}
+	return dc.Image().(*image.RGBA), nil
+}
+
+// readLogo decodes the image in the body of req, if there is one
+func readLogo(w http.ResponseWriter, req *http.Request) (image.Image, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxQRLogoBytes))
+	if err != nil {
+		return nil, badRequest("invalid_image", "Could not read logo", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	logo, err := decodeImage(data, MaxQRLogoSide)
+	if err != nil {
+		return nil, badRequest("invalid_image", "Could not decode logo, send a PNG, JPEG or GIF body", err)
+	}
+	return logo, nil
+}
+
+// QR draws a QR code of ?content= centred on the app layer, or the layer
+// given by ?layer=. A PNG, JPEG or GIF in the body is drawn over the middle
+// of the code as a logo.
+func (b *PiboxFrameBuffer) QR(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	priority, err := queryPriority(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	layer, err := queryLayer(query, LayerApp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	layerOpts, err := parseLayerOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	opts, err := parseQROptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if opts.logo, err = readLogo(w, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	// a logo hides part of the code, so recover from more damage unless
+	// told otherwise
+	if opts.logo != nil && query.Get("level") == "" {
+		opts.level = qrcode.High
+	}
+	frame, err := opts.render(b.config.screenSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b.player.StopOn(layer)
+	_, err = b.drawLayer(req.Context(), priority, layer, layerOpts, func(l *image.RGBA) {
+		draw.Draw(l, l.Rect, frame, image.Point{}, draw.Src)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "QR code drawn\n")
+}
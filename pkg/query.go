@@ -0,0 +1,20 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// queryInt reads an integer query parameter, returning def if it is absent
+func queryInt(query url.Values, name string, def int) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, badRequest("invalid_parameter", fmt.Sprintf("%s must be an integer", name), err)
+	}
+	return i, nil
+}
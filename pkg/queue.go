@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// DefaultQueueSize is how many draws may wait for the display at once
+const DefaultQueueSize = 16
+
+// Priority orders the draws waiting in the render queue. Higher priorities
+// are drawn first, draws of the same priority in the order they arrived.
+type Priority int
+
+const (
+	// PriorityLow is for screens drawn in the background, like stats
+	PriorityLow Priority = iota
+	// PriorityNormal is the default for draw requests
+	PriorityNormal
+	// PriorityHigh is for alerts that should pre-empt everything else
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// queryPriority reads ?priority=, which is low, normal or high
+func queryPriority(query url.Values) (Priority, error) {
+	switch v := query.Get("priority"); v {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return 0, badRequest("invalid_parameter", fmt.Sprintf("Unknown priority %q, use low, normal or high", v), nil)
+	}
+}
+
+// queueFull reports that too many draws are already waiting
+func queueFull() *Error {
+	e := newError(http.StatusTooManyRequests, "queue_full", "Too many draws are waiting for the display, try again later", nil)
+	e.RetryAfter = 1
+	return e
+}
+
+// queueClosed reports a draw submitted after the display was shut down
+func queueClosed() *Error {
+	return newError(http.StatusServiceUnavailable, "display_closed", "The display is shutting down", nil)
+}
+
+// renderJob is a draw waiting in the render queue
+type renderJob struct {
+	priority Priority
+	// full jobs redraw the whole screen, which makes any older job of the
+	// same or lower priority that is still waiting pointless
+	full bool
+	draw func(fb *display.Display) error
+	done chan error
+}
+
+// renderQueue serialises everything drawn to the display. A single goroutine
+// owns the device and runs the queued draws one at a time, so concurrent
+// requests can not interleave their SPI commands.
+type renderQueue struct {
+	open func() (*display.Display, error)
+	size int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []*renderJob
+	closed  bool
+	stopped chan struct{}
+
+	coalesced uint64
+}
+
+// newRenderQueue starts a queue holding up to size draws. open is called
+// from the queue's goroutine before every draw.
+func newRenderQueue(size int, open func() (*display.Display, error)) *renderQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &renderQueue{
+		open:    open,
+		size:    size,
+		stopped: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// Draw queues draw and waits until it ran. full marks a draw that replaces
+// the whole screen. Older draws it makes pointless are dropped and their
+// callers told they succeeded, because the screen already shows something
+// newer. Draw fails with a 429 when the queue is full and a 503 once it is
+// closed. When ctx is done before the draw started it is taken off the queue.
+func (q *renderQueue) Draw(ctx context.Context, priority Priority, full bool, draw func(fb *display.Display) error) error {
+	return q.DrawChange(ctx, priority, full, nil, draw)
+}
+
+// DrawChange is Draw for a draw that shows a change made by change. change
+// is called once the draw has its place in the queue and before it is
+// queued, so nothing is changed when the queue turns the draw away. When
+// change fails the draw is not queued and Draw returns its error.
+func (q *renderQueue) DrawChange(ctx context.Context, priority Priority, full bool, change func() error, draw func(fb *display.Display) error) error {
+	job := &renderJob{
+		priority: priority,
+		full:     full,
+		draw:     draw,
+		done:     make(chan error, 1),
+	}
+
+	q.mu.Lock()
+	if err := q.admitLocked(priority, full); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if change != nil {
+		if err := change(); err != nil {
+			q.mu.Unlock()
+			return err
+		}
+	}
+	if full {
+		q.coalesceLocked(priority)
+	}
+	q.jobs = append(q.jobs, job)
+	q.cond.Signal()
+	q.mu.Unlock()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		// a draw that already started runs to the end, nobody waits for it
+		q.mu.Lock()
+		q.removeLocked(job)
+		q.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Check returns the error Draw would fail with right now, so a caller can
+// find out before it changes anything the draw would show
+func (q *renderQueue) Check(priority Priority, full bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.admitLocked(priority, full)
+}
+
+// admitLocked returns the error a draw fails with when there is no room for
+// it, counting only the draws it would not replace
+func (q *renderQueue) admitLocked(priority Priority, full bool) error {
+	if q.closed {
+		return queueClosed()
+	}
+	waiting := len(q.jobs)
+	if full {
+		waiting = 0
+		for _, job := range q.jobs {
+			if job.priority > priority {
+				waiting++
+			}
+		}
+	}
+	if waiting >= q.size {
+		return queueFull()
+	}
+	return nil
+}
+
+// coalesceLocked drops the waiting draws a new full frame of priority
+// replaces
+func (q *renderQueue) coalesceLocked(priority Priority) {
+	jobs := q.jobs[:0]
+	for _, job := range q.jobs {
+		if job.priority <= priority {
+			job.done <- nil
+			q.coalesced++
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	for i := len(jobs); i < len(q.jobs); i++ {
+		q.jobs[i] = nil
+	}
+	q.jobs = jobs
+}
+
+func (q *renderQueue) removeLocked(job *renderJob) {
+	for i, j := range q.jobs {
+		if j == job {
+			q.deleteLocked(i)
+			return
+		}
+	}
+}
+
+func (q *renderQueue) deleteLocked(i int) {
+	copy(q.jobs[i:], q.jobs[i+1:])
+	q.jobs[len(q.jobs)-1] = nil
+	q.jobs = q.jobs[:len(q.jobs)-1]
+}
+
+// next waits for the oldest draw of the highest priority. It returns nil
+// once the queue is closed and empty.
+func (q *renderQueue) next() *renderJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 {
+		if q.closed {
+			return nil
+		}
+		q.cond.Wait()
+	}
+	best := 0
+	for i, job := range q.jobs {
+		if job.priority > q.jobs[best].priority {
+			best = i
+		}
+	}
+	job := q.jobs[best]
+	q.deleteLocked(best)
+	return job
+}
+
+func (q *renderQueue) run() {
+	defer close(q.stopped)
+	for {
+		job := q.next()
+		if job == nil {
+			return
+		}
+		fb, err := q.open()
+		if err == nil {
+			err = job.draw(fb)
+		}
+		job.done <- err
+	}
+}
+
+// Len returns how many draws are waiting
+func (q *renderQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// Coalesced returns how many draws were dropped because a newer full frame
+// replaced them
+func (q *renderQueue) Coalesced() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.coalesced
+}
+
+// Close stops accepting draws, runs the ones still waiting and stops the
+// queue's goroutine. The display then belongs to the caller.
+func (q *renderQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.stopped
+}
@@ -0,0 +1,277 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// testQueue is a render queue drawing to the memory display. The draw its
+// block method queues holds the queue up until it is released, so that
+// draws queued meanwhile wait behind it.
+type testQueue struct {
+	*renderQueue
+	t *testing.T
+
+	mu  sync.Mutex
+	ran []string
+}
+
+func newTestQueue(t *testing.T, size int) *testQueue {
+	if err := display.SetBackend(display.BackendMemory); err != nil {
+		t.Fatal(err)
+	}
+	q := &testQueue{renderQueue: newRenderQueue(size, display.Init), t: t}
+	t.Cleanup(q.Close)
+	return q
+}
+
+// draw returns a draw that records it ran under name and fails with err
+func (q *testQueue) draw(name string, err error) func(fb *display.Display) error {
+	return func(fb *display.Display) error {
+		if fb == nil {
+			q.t.Error("draw run without a display")
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.ran = append(q.ran, name)
+		return err
+	}
+}
+
+// block starts a draw and waits until it is running, returning the function
+// that lets it finish
+func (q *testQueue) block() (release func()) {
+	started, released := make(chan struct{}), make(chan struct{})
+	go q.Draw(context.Background(), PriorityNormal, false, func(fb *display.Display) error {
+		close(started)
+		<-released
+		return nil
+	})
+	<-started
+	return func() { close(released) }
+}
+
+// queue starts a draw in the background and waits until it is waiting in the
+// queue. The result of Draw is sent on the returned channel.
+func (q *testQueue) queue(ctx context.Context, name string, priority Priority, full bool) <-chan error {
+	q.t.Helper()
+	waiting := q.Len()
+	result := make(chan error, 1)
+	go func() {
+		result <- q.Draw(ctx, priority, full, q.draw(name, nil))
+	}()
+	for deadline := time.Now().Add(time.Second); q.Len() == waiting; {
+		select {
+		case err := <-result:
+			q.t.Fatalf("%s: Draw returned %v before it was queued", name, err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			q.t.Fatalf("%s was never queued", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return result
+}
+
+func (q *testQueue) order() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.ran...)
+}
+
+func waitDraw(t *testing.T, name string, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(time.Second):
+		t.Fatalf("%s: Draw never returned", name)
+		return nil
+	}
+}
+
+func checkOrder(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("draws ran in the order %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("draws ran in the order %v, want %v", got, want)
+		}
+	}
+}
+
+// checkStatus checks err is the *Error with the given status
+func checkStatus(t *testing.T, err error, status int) *Error {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) || e.Status != status {
+		t.Fatalf("Draw returned %v, want a %d", err, status)
+	}
+	return e
+}
+
+func TestRenderQueuePriority(t *testing.T) {
+	q := newTestQueue(t, DefaultQueueSize)
+	release := q.block()
+	ctx := context.Background()
+	results := map[string]<-chan error{
+		"low":     q.queue(ctx, "low", PriorityLow, false),
+		"normal1": q.queue(ctx, "normal1", PriorityNormal, false),
+		"high":    q.queue(ctx, "high", PriorityHigh, false),
+		"normal2": q.queue(ctx, "normal2", PriorityNormal, false),
+	}
+	release()
+	for name, result := range results {
+		if err := waitDraw(t, name, result); err != nil {
+			t.Errorf("%s: Draw returned %v", name, err)
+		}
+	}
+	checkOrder(t, q.order(), "high", "normal1", "normal2", "low")
+}
+
+func TestRenderQueueCoalesce(t *testing.T) {
+	q := newTestQueue(t, DefaultQueueSize)
+	release := q.block()
+	ctx := context.Background()
+	low := q.queue(ctx, "low", PriorityLow, true)
+	high := q.queue(ctx, "high", PriorityHigh, false)
+	normal := q.queue(ctx, "normal", PriorityNormal, false)
+
+	// a full frame replaces the waiting draws of its priority and below,
+	// whose callers are told they succeeded without them running
+	full := q.queue(ctx, "full", PriorityNormal, true)
+	for name, result := range map[string]<-chan error{"low": low, "normal": normal} {
+		if err := waitDraw(t, name, result); err != nil {
+			t.Errorf("%s: Draw returned %v, want nil", name, err)
+		}
+	}
+	if got := q.Coalesced(); got != 2 {
+		t.Errorf("Coalesced() = %d, want 2", got)
+	}
+
+	release()
+	for name, result := range map[string]<-chan error{"high": high, "full": full} {
+		if err := waitDraw(t, name, result); err != nil {
+			t.Errorf("%s: Draw returned %v", name, err)
+		}
+	}
+	checkOrder(t, q.order(), "high", "full")
+}
+
+func TestRenderQueueFull(t *testing.T) {
+	q := newTestQueue(t, 2)
+	release := q.block()
+	defer release()
+	ctx := context.Background()
+	q.queue(ctx, "first", PriorityNormal, false)
+	q.queue(ctx, "second", PriorityNormal, false)
+
+	e := checkStatus(t, q.Draw(ctx, PriorityHigh, false, q.draw("third", nil)), http.StatusTooManyRequests)
+	if e.RetryAfter != 1 {
+		t.Errorf("RetryAfter = %d, want 1", e.RetryAfter)
+	}
+	checkStatus(t, q.Check(PriorityHigh, false), http.StatusTooManyRequests)
+
+	// nothing is changed for a draw the queue turns away
+	changed := false
+	err := q.DrawChange(ctx, PriorityHigh, false, func() error {
+		changed = true
+		return nil
+	}, q.draw("change", nil))
+	checkStatus(t, err, http.StatusTooManyRequests)
+	if changed {
+		t.Error("the change was made for a draw that was turned away")
+	}
+
+	// a full frame is only turned away when the draws it would not replace
+	// fill the queue, and then replaces nothing
+	checkStatus(t, q.Draw(ctx, PriorityLow, true, q.draw("low", nil)), http.StatusTooManyRequests)
+	if got := q.Coalesced(); got != 0 {
+		t.Errorf("Coalesced() = %d after a rejected full frame, want 0", got)
+	}
+	if err := q.Check(PriorityNormal, true); err != nil {
+		t.Errorf("Check of a full frame replacing the queue = %v, want nil", err)
+	}
+}
+
+func TestRenderQueueErrors(t *testing.T) {
+	q := newTestQueue(t, DefaultQueueSize)
+	failed := errors.New("failed")
+	if err := q.Draw(context.Background(), PriorityNormal, false, q.draw("fails", failed)); err != failed {
+		t.Errorf("Draw returned %v, want the draw's error", err)
+	}
+
+	// a change that fails keeps its draw off the queue
+	err := q.DrawChange(context.Background(), PriorityNormal, false, func() error {
+		return failed
+	}, q.draw("unchanged", nil))
+	if err != failed {
+		t.Errorf("DrawChange returned %v, want the change's error", err)
+	}
+
+	// a draw whose caller gave up before it started never runs
+	release := q.block()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := q.queue(ctx, "cancelled", PriorityNormal, false)
+	cancel()
+	if err := waitDraw(t, "cancelled", result); err != context.Canceled {
+		t.Errorf("Draw returned %v, want %v", err, context.Canceled)
+	}
+	if got := q.Len(); got != 0 {
+		t.Errorf("Len() = %d after the draw was cancelled, want 0", got)
+	}
+	release()
+	if err := q.Draw(context.Background(), PriorityNormal, false, q.draw("after", nil)); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(t, q.order(), "fails", "after")
+}
+
+func TestRenderQueueClose(t *testing.T) {
+	q := newTestQueue(t, DefaultQueueSize)
+	release := q.block()
+	ctx := context.Background()
+	first := q.queue(ctx, "first", PriorityNormal, false)
+	second := q.queue(ctx, "second", PriorityLow, false)
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	for deadline := time.Now().Add(time.Second); q.Check(PriorityNormal, false) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("the queue never closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkStatus(t, q.Draw(ctx, PriorityHigh, false, q.draw("late", nil)), http.StatusServiceUnavailable)
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a draw was running")
+	default:
+	}
+
+	// the draws already waiting still run before Close returns
+	release()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close never returned")
+	}
+	for name, result := range map[string]<-chan error{"first": first, "second": second} {
+		if err := waitDraw(t, name, result); err != nil {
+			t.Errorf("%s: Draw returned %v", name, err)
+		}
+	}
+	checkOrder(t, q.order(), "first", "second")
+}
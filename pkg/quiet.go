@@ -0,0 +1,541 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubesail/pibox-framebuffer/display"
+)
+
+// DefaultQuietWake is how long /quiet-hours/wake lifts quiet hours for, and
+// how long a draw keeps a blanked display on during them
+const DefaultQuietWake = 5 * time.Minute
+
+// MaxQuietWake is the longest a request may lift quiet hours for
+const MaxQuietWake = 24 * time.Hour
+
+// quietCheckInterval is the longest the schedule goes unchecked, so a clock
+// that jumps is caught up with
+const quietCheckInterval = time.Minute
+
+// Modes of quiet hours
+const (
+	QuietBlank = "blank"
+	QuietDim   = "dim"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// QuietSchedule is when quiet hours are, as times of day on days of the week
+type QuietSchedule struct {
+	location *time.Location
+	periods  []quietPeriod
+}
+
+// quietPeriod is quiet from start to end on each of days. A period that ends
+// before it starts runs past midnight into the next day.
+type quietPeriod struct {
+	days [7]bool
+	// start and end are minutes since midnight
+	start, end int
+}
+
+// QuietPeriod is one period of the schedule in /quiet-hours
+type QuietPeriod struct {
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+// ParseQuietHours parses a schedule of periods separated by ";", each days of
+// the week and one or more time ranges, like
+// "mon-thu,sun 22:00-07:00; fri,sat 23:30-09:00". Times are in location. An
+// empty schedule has no quiet hours and returns nil.
+func ParseQuietHours(s string, location *time.Location) (*QuietSchedule, error) {
+	schedule := &QuietSchedule{location: location}
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid period %q, use days and times like mon-fri 22:00-07:00", strings.TrimSpace(entry))
+		}
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range fields[1:] {
+			times := strings.Split(r, "-")
+			if len(times) != 2 {
+				return nil, fmt.Errorf("invalid time range %q, use from-to like 22:00-07:00", r)
+			}
+			start, err := parseTimeOfDay(times[0])
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseTimeOfDay(times[1])
+			if err != nil {
+				return nil, err
+			}
+			if start == end || start == 24*60 {
+				return nil, fmt.Errorf("invalid time range %q", r)
+			}
+			schedule.periods = append(schedule.periods, quietPeriod{days: days, start: start, end: end})
+		}
+	}
+	if len(schedule.periods) == 0 {
+		return nil, nil
+	}
+	return schedule, nil
+}
+
+// parseWeekdays parses days like "mon-fri,sun" or "daily"
+func parseWeekdays(s string) ([7]bool, error) {
+	var days [7]bool
+	if strings.EqualFold(s, "daily") {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, d := range strings.Split(s, ",") {
+		bounds := strings.Split(d, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("invalid days %q", d)
+		}
+		from, err := parseWeekday(bounds[0])
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = parseWeekday(bounds[1]); err != nil {
+				return days, err
+			}
+		}
+		// a range like fri-mon wraps around the weekend
+		for i := from; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseWeekday(s string) (int, error) {
+	for i, name := range weekdays {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q, use one of %s or daily", s, strings.Join(weekdays, ", "))
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight. 24:00 is the end
+// of the day.
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		hour, herr := strconv.Atoi(parts[0])
+		minute, merr := strconv.Atoi(parts[1])
+		if herr == nil && merr == nil && hour >= 0 && minute >= 0 && minute < 60 &&
+			(hour < 24 || hour == 24 && minute == 0) {
+			return hour*60 + minute, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+}
+
+func formatTimeOfDay(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Quiet reports whether t falls in quiet hours
+func (s *QuietSchedule) Quiet(t time.Time) bool {
+	t = t.In(s.location)
+	day, minute := int(t.Weekday()), t.Hour()*60+t.Minute()
+	yesterday := (day + 6) % 7
+	for _, p := range s.periods {
+		if p.start < p.end {
+			if p.days[day] && minute >= p.start && minute < p.end {
+				return true
+			}
+		} else if p.days[day] && minute >= p.start || p.days[yesterday] && minute < p.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns when quiet hours next start or end after t. A schedule that is
+// quiet all week never changes.
+func (s *QuietSchedule) Next(t time.Time) (time.Time, bool) {
+	quiet := s.Quiet(t)
+	// quiet hours stay as they are between the times where they may change
+	for _, next := range s.changes(t) {
+		if s.Quiet(next) != quiet {
+			return next.In(t.Location()), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// changes returns the times quiet hours may start or end over the week after
+// t, in order. These are when a period starts or ends, as often as the clock
+// reads that time, and when the clock is changed, which can skip past a start
+// or an end.
+func (s *QuietSchedule) changes(t time.Time) []time.Time {
+	year, month, day := t.In(s.location).Date()
+	var times []time.Time
+	// the day before t is where a period running past midnight into t's day
+	// starts, and a week on, a day more covers the clock being changed
+	for i := -1; i <= 8; i++ {
+		if change, ok := s.clockChange(year, month, day+i); ok {
+			times = append(times, change)
+		}
+		weekday := time.Date(year, month, day+i, 0, 0, 0, 0, time.UTC).Weekday()
+		for _, p := range s.periods {
+			if !p.days[weekday] {
+				continue
+			}
+			end := p.end
+			if end <= p.start {
+				end += 24 * 60
+			}
+			times = append(times, s.at(year, month, day+i, p.start)...)
+			times = append(times, s.at(year, month, day+i, end)...)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	after := times[:0]
+	for _, next := range times {
+		if next.After(t) {
+			after = append(after, next)
+		}
+	}
+	return after
+}
+
+// at returns the times the clock reads minute after midnight on a day. That
+// is none when the clock is put forward past it, and twice when it is put back
+// over it.
+func (s *QuietSchedule) at(year int, month time.Month, day, minute int) []time.Time {
+	wall := time.Date(year, month, day, 0, minute, 0, 0, time.UTC)
+	var times []time.Time
+	for _, offset := range s.offsets(wall) {
+		t := wall.Add(-time.Duration(offset) * time.Second).In(s.location)
+		if t.Hour() == wall.Hour() && t.Minute() == wall.Minute() && t.Day() == wall.Day() {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// offsets returns the offsets from UTC the location has on the day of wall
+func (s *QuietSchedule) offsets(wall time.Time) []int {
+	year, month, day := wall.Date()
+	_, start := time.Date(year, month, day, 0, 0, 0, 0, s.location).Zone()
+	_, end := time.Date(year, month, day+1, 0, 0, 0, 0, s.location).Zone()
+	if start == end {
+		return []int{start}
+	}
+	return []int{start, end}
+}
+
+// clockChange returns when the clock is put forward or back on a day, if it
+// is
+func (s *QuietSchedule) clockChange(year int, month time.Month, day int) (time.Time, bool) {
+	offset := func(unix int64) int {
+		_, offset := time.Unix(unix, 0).In(s.location).Zone()
+		return offset
+	}
+	from := time.Date(year, month, day, 0, 0, 0, 0, s.location).Unix()
+	to := time.Date(year, month, day+1, 0, 0, 0, 0, s.location).Unix()
+	before := offset(from)
+	if offset(to) == before {
+		return time.Time{}, false
+	}
+	for to-from > 1 {
+		mid := from + (to-from)/2
+		if offset(mid) == before {
+			from = mid
+		} else {
+			to = mid
+		}
+	}
+	return time.Unix(to, 0).In(s.location), true
+}
+
+// Periods lists the periods of the schedule
+func (s *QuietSchedule) Periods() []QuietPeriod {
+	periods := make([]QuietPeriod, len(s.periods))
+	for i, p := range s.periods {
+		days := []string{}
+		for d, on := range p.days {
+			if on {
+				days = append(days, weekdays[d])
+			}
+		}
+		periods[i] = QuietPeriod{Days: days, From: formatTimeOfDay(p.start), To: formatTimeOfDay(p.end)}
+	}
+	return periods
+}
+
+// QuietHoursState is the response of /quiet-hours
+type QuietHoursState struct {
+	Enabled bool `json:"enabled"`
+	// Mode is blank to put the display to sleep during quiet hours, or dim to
+	// turn the backlight down to Brightness
+	Mode       string        `json:"mode"`
+	Brightness int           `json:"brightness"`
+	Timezone   string        `json:"timezone,omitempty"`
+	Periods    []QuietPeriod `json:"periods"`
+	// Scheduled is whether the schedule says it is quiet hours now, and
+	// Active whether they are in effect, which they are not while woken up
+	Scheduled bool `json:"scheduled"`
+	Active    bool `json:"active"`
+	// NextChange is when quiet hours next start or end by the schedule
+	NextChange *time.Time `json:"nextChange,omitempty"`
+	// WokenUntil is when quiet hours are back after /quiet-hours/wake
+	WokenUntil *time.Time `json:"wokenUntil,omitempty"`
+}
+
+// quietHours dims or blanks the display and holds the screens redrawn in the
+// background while the schedule says it is quiet
+type quietHours struct {
+	schedule *QuietSchedule
+	// brightness is what the backlight is dimmed to, 0 to blank the display
+	brightness int
+
+	mu         sync.Mutex
+	active     bool
+	wokenUntil time.Time
+	// restore is the brightness dimming turned the backlight down from
+	restore int
+
+	// wake tells runQuietHours that wokenUntil changed
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (q *quietHours) init(schedule *QuietSchedule, brightness int) {
+	q.schedule = schedule
+	q.brightness = brightness
+	q.wake = make(chan struct{}, 1)
+}
+
+func (q *quietHours) mode() string {
+	if q.brightness > 0 {
+		return QuietDim
+	}
+	return QuietBlank
+}
+
+// paused reports whether the screens redrawn in the background are held
+func (q *quietHours) paused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active
+}
+
+// wakeUntil lifts quiet hours until t, or puts them back in effect if t has
+// passed
+func (q *quietHours) wakeUntil(t time.Time) {
+	q.mu.Lock()
+	q.wokenUntil = t
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *quietHours) state() QuietHoursState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := QuietHoursState{
+		Enabled:    q.schedule != nil,
+		Mode:       q.mode(),
+		Brightness: q.brightness,
+		Periods:    []QuietPeriod{},
+	}
+	if q.schedule == nil {
+		return s
+	}
+	now := time.Now()
+	s.Timezone = q.schedule.location.String()
+	s.Periods = q.schedule.Periods()
+	s.Scheduled = q.schedule.Quiet(now)
+	if next, ok := q.schedule.Next(now); ok {
+		s.NextChange = &next
+	}
+	if now.Before(q.wokenUntil) {
+		until := q.wokenUntil
+		s.WokenUntil = &until
+	}
+	s.Active = s.Scheduled && s.WokenUntil == nil
+	return s
+}
+
+// StartQuietHours follows the schedule until Shutdown. It is started after
+// the backlight, which it may dim straight away.
+func (b *PiboxFrameBuffer) StartQuietHours() {
+	q := &b.quiet
+	if q.schedule == nil || q.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(withSource(context.Background(), SourceSchedule))
+	q.cancel, q.done = cancel, make(chan struct{})
+	go b.runQuietHours(ctx)
+}
+
+// stopQuietHours stops following the schedule, leaving the display as it is
+func (b *PiboxFrameBuffer) stopQuietHours() {
+	q := &b.quiet
+	if q.cancel == nil {
+		return
+	}
+	q.cancel()
+	<-q.done
+}
+
+func (b *PiboxFrameBuffer) runQuietHours(ctx context.Context) {
+	q := &b.quiet
+	defer close(q.done)
+	for {
+		now := time.Now()
+		q.mu.Lock()
+		quiet := q.schedule.Quiet(now) && !now.Before(q.wokenUntil)
+		changed := quiet != q.active
+		q.active = quiet
+		wokenUntil := q.wokenUntil
+		q.mu.Unlock()
+
+		var err error
+		switch {
+		case changed && quiet:
+			err = b.enterQuietHours(ctx)
+		case changed:
+			err = b.leaveQuietHours(ctx)
+		case quiet && q.brightness == 0 && !b.idle.isAsleep() && now.Sub(b.idle.lastDraw()) >= DefaultQuietWake:
+			// something drawn woke the display up, it has been seen
+			err = b.sleepDisplay(ctx, true)
+		}
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "Could not apply quiet hours: %v\n", err)
+		}
+
+		wait := quietCheckInterval
+		if next, ok := q.schedule.Next(now); ok && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		if wokenUntil.After(now) && wokenUntil.Sub(now) < wait {
+			wait = wokenUntil.Sub(now)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// enterQuietHours blanks or dims the display. The background screens hold
+// on their own once quiet hours are active.
+func (b *PiboxFrameBuffer) enterQuietHours(ctx context.Context) error {
+	q := &b.quiet
+	if q.brightness == 0 {
+		return b.sleepDisplay(ctx, true)
+	}
+	return b.queue.Draw(ctx, PriorityNormal, false, func(fb *display.Display) error {
+		q.mu.Lock()
+		q.restore = fb.Brightness()
+		q.mu.Unlock()
+		fb.SetBrightness(q.brightness, b.config.backlightFade)
+		return nil
+	})
+}
+
+// leaveQuietHours brings the background screens up to date and the display
+// back to how it was
+func (b *PiboxFrameBuffer) leaveQuietHours(ctx context.Context) error {
+	q := &b.quiet
+	if b.StatsRunning() {
+		if err := b.drawStats(withSource(ctx, SourceStats)); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not draw stats: %v\n", err)
+		}
+	}
+	b.carousel.mu.Lock()
+	b.carousel.wakeLocked()
+	b.carousel.mu.Unlock()
+
+	if q.brightness == 0 {
+		return b.redraw(ctx, PriorityNormal)
+	}
+	return b.queue.Draw(ctx, PriorityNormal, false, func(fb *display.Display) error {
+		q.mu.Lock()
+		restore := q.restore
+		q.mu.Unlock()
+		// a brightness set during quiet hours is kept
+		if fb.Brightness() == q.brightness {
+			fb.SetBrightness(restore, b.config.backlightFade)
+		}
+		return nil
+	})
+}
+
+// QuietHours reports the schedule and whether quiet hours are in effect
+func (b *PiboxFrameBuffer) QuietHours(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.quiet.state())
+}
+
+// WakeQuietHours lifts quiet hours on POST or PUT for ?for= or 5 minutes,
+// and puts them back in effect on DELETE
+func (b *PiboxFrameBuffer) WakeQuietHours(w http.ResponseWriter, req *http.Request) {
+	q := &b.quiet
+	switch req.Method {
+	case http.MethodPost, http.MethodPut:
+		if q.schedule == nil {
+			writeError(w, newError(http.StatusConflict, "quiet_hours_disabled", "No quiet hours are configured", nil))
+			return
+		}
+		d := DefaultQuietWake
+		if v := req.URL.Query().Get("for"); v != "" {
+			var err error
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 || d > MaxQuietWake {
+				writeError(w, badRequest("invalid_parameter", fmt.Sprintf("for must be a duration like 5m, up to %v", MaxQuietWake), err))
+				return
+			}
+		}
+		q.wakeUntil(time.Now().Add(d))
+	case http.MethodDelete:
+		q.wakeUntil(time.Time{})
+	default:
+		writeError(w, methodNotAllowed(w, "POST, PUT, DELETE"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.state())
+}
@@ -0,0 +1,259 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func parseSchedule(t *testing.T, s string, location *time.Location) *QuietSchedule {
+	t.Helper()
+	schedule, err := ParseQuietHours(s, location)
+	if err != nil {
+		t.Fatalf("ParseQuietHours(%q): %v", s, err)
+	}
+	if schedule == nil {
+		t.Fatalf("ParseQuietHours(%q) has no quiet hours", s)
+	}
+	return schedule
+}
+
+// parseTime parses a time like "2021-03-12 22:00" in location
+func parseTime(t *testing.T, s string, location *time.Location) time.Time {
+	t.Helper()
+	at, err := time.ParseInLocation("2006-01-02 15:04", s, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+func TestParseQuietHours(t *testing.T) {
+	for _, tt := range []struct {
+		schedule string
+		want     []QuietPeriod
+	}{
+		{"mon-fri 22:00-07:00", []QuietPeriod{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "22:00", To: "07:00"},
+		}},
+		{"mon-thu,sun 22:00-07:00; fri,sat 23:30-09:00", []QuietPeriod{
+			{Days: []string{"sun", "mon", "tue", "wed", "thu"}, From: "22:00", To: "07:00"},
+			{Days: []string{"fri", "sat"}, From: "23:30", To: "09:00"},
+		}},
+		{"fri-mon 12:00-13:00 20:00-24:00", []QuietPeriod{
+			{Days: []string{"sun", "mon", "fri", "sat"}, From: "12:00", To: "13:00"},
+			{Days: []string{"sun", "mon", "fri", "sat"}, From: "20:00", To: "24:00"},
+		}},
+		{"Daily 00:00-06:30;", []QuietPeriod{
+			{Days: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}, From: "00:00", To: "06:30"},
+		}},
+	} {
+		schedule := parseSchedule(t, tt.schedule, time.UTC)
+		if got := schedule.Periods(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuietHours(%q) = %+v, want %+v", tt.schedule, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", " ; "} {
+		if schedule, err := ParseQuietHours(s, time.UTC); schedule != nil || err != nil {
+			t.Errorf("ParseQuietHours(%q) = %v, %v, want no quiet hours", s, schedule, err)
+		}
+	}
+
+	for _, s := range []string{
+		"22:00-07:00",
+		"mon",
+		"someday 22:00-07:00",
+		"mon-tue-wed 22:00-07:00",
+		"mon 22:00",
+		"mon 22:00-07:00-08:00",
+		"mon 22:00-22:00",
+		"mon 24:00-07:00",
+		"mon 24:30-07:00",
+		"mon 22:60-07:00",
+		"mon 7-8",
+		"mon 22:00-07:00; tue",
+	} {
+		if _, err := ParseQuietHours(s, time.UTC); err == nil {
+			t.Errorf("ParseQuietHours(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	// 2021-03-12 is a Friday
+	for _, tt := range []struct {
+		schedule string
+		at       string
+		want     bool
+	}{
+		{"mon-fri 09:00-17:00", "2021-03-12 09:00", true},
+		{"mon-fri 09:00-17:00", "2021-03-12 16:59", true},
+		{"mon-fri 09:00-17:00", "2021-03-12 17:00", false},
+		{"mon-fri 09:00-17:00", "2021-03-12 08:59", false},
+		{"mon-fri 09:00-17:00", "2021-03-13 12:00", false},
+
+		// running past midnight is quiet into the next day, even one not
+		// listed
+		{"fri 22:00-07:00", "2021-03-12 23:00", true},
+		{"fri 22:00-07:00", "2021-03-13 06:59", true},
+		{"fri 22:00-07:00", "2021-03-13 07:00", false},
+		{"fri 22:00-07:00", "2021-03-13 23:00", false},
+		{"fri 22:00-07:00", "2021-03-12 06:00", false},
+
+		// from Saturday night into Sunday, and a range of days over the
+		// weekend
+		{"sat 23:00-01:00", "2021-03-14 00:30", true},
+		{"sat 23:00-01:00", "2021-03-08 00:30", false},
+		{"fri-mon 12:00-13:00", "2021-03-15 12:30", true},
+		{"fri-mon 12:00-13:00", "2021-03-14 12:30", true},
+		{"fri-mon 12:00-13:00", "2021-03-16 12:30", false},
+		{"fri-mon 12:00-13:00", "2021-03-11 12:30", false},
+
+		// 24:00 is up to midnight, and a start at midnight no earlier
+		{"fri 20:00-24:00", "2021-03-12 23:59", true},
+		{"fri 20:00-24:00", "2021-03-13 00:00", false},
+		{"sat 00:00-06:00", "2021-03-13 00:00", true},
+		{"sat 00:00-06:00", "2021-03-12 23:59", false},
+		{"daily 23:00-01:00", "2021-03-10 00:15", true},
+	} {
+		schedule := parseSchedule(t, tt.schedule, time.UTC)
+		at := parseTime(t, tt.at, time.UTC)
+		if got := schedule.Quiet(at); got != tt.want {
+			t.Errorf("%q: Quiet(%s %s) = %v, want %v", tt.schedule, at.Weekday(), tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestQuietLocation(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	schedule := parseSchedule(t, "daily 22:00-07:00", berlin)
+	// 21:30 UTC is 22:30 in Berlin in winter, but still 23:30 in summer
+	for _, tt := range []struct {
+		at   string
+		want bool
+	}{
+		{"2021-01-15 21:30", true},
+		{"2021-01-15 20:30", false},
+		{"2021-07-15 20:30", true},
+		{"2021-07-15 04:30", true},
+		{"2021-07-15 05:30", false},
+	} {
+		if got := schedule.Quiet(parseTime(t, tt.at, time.UTC)); got != tt.want {
+			t.Errorf("Quiet(%s UTC) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	// 2021-03-14 and 2021-11-07 are Sundays, the clock going forward from
+	// 02:00 to 03:00 and back from 02:00 to 01:00 in New York
+	for _, tt := range []struct {
+		name     string
+		schedule string
+		location *time.Location
+		at       string
+		want     string
+	}{
+		{"start", "mon-fri 22:00-07:00", time.UTC, "2021-03-10 12:00", "2021-03-10 22:00"},
+		{"end past midnight", "mon-fri 22:00-07:00", time.UTC, "2021-03-10 23:00", "2021-03-11 07:00"},
+		{"over the weekend", "mon-fri 22:00-07:00", time.UTC, "2021-03-13 07:00", "2021-03-15 22:00"},
+		{"over the weekend, ending", "mon-fri 22:00-07:00", time.UTC, "2021-03-13 06:00", "2021-03-13 07:00"},
+		{"a week on", "wed 09:00-10:00", time.UTC, "2021-03-10 09:30", "2021-03-10 10:00"},
+		{"to next week", "wed 09:00-10:00", time.UTC, "2021-03-10 10:00", "2021-03-17 09:00"},
+		{"saturday into sunday", "sat 23:00-01:00", time.UTC, "2021-03-13 23:30", "2021-03-14 01:00"},
+		{"back to back", "mon 20:00-24:00; tue 00:00-06:00", time.UTC, "2021-03-08 21:00", "2021-03-09 06:00"},
+		{"overlapping", "daily 22:00-07:00; mon 06:00-08:00", time.UTC, "2021-03-09 00:00", "2021-03-09 07:00"},
+		{"on the change", "daily 22:00-07:00", time.UTC, "2021-03-10 22:00", "2021-03-11 07:00"},
+
+		{"in a location", "daily 22:00-07:00", newYork, "2021-03-10 12:00", "2021-03-10 22:00"},
+		{"clock forward, ending", "daily 22:00-07:00", newYork, "2021-03-13 23:00", "2021-03-14 07:00"},
+		{"clock forward past the start", "sun 02:30-05:00", newYork, "2021-03-14 00:00", "2021-03-14 03:00"},
+		{"clock forward past the end", "sun 01:00-02:30", newYork, "2021-03-14 01:30", "2021-03-14 03:00"},
+		{"clock back, ending", "daily 22:00-07:00", newYork, "2021-11-06 23:00", "2021-11-07 07:00"},
+		{"clock back to the start", "sun 01:15-01:45", newYork, "2021-11-07 01:00", "2021-11-07 01:15"},
+	} {
+		schedule := parseSchedule(t, tt.schedule, tt.location)
+		at := parseTime(t, tt.at, tt.location)
+		want := parseTime(t, tt.want, tt.location)
+		next, ok := schedule.Next(at)
+		if !ok || !next.Equal(want) {
+			t.Errorf("%s: Next(%s) = %s, %v, want %s", tt.name, at, next, ok, want)
+		}
+	}
+
+	// put back, the clock reads the period's times a second time
+	schedule := parseSchedule(t, "sun 01:15-01:45", newYork)
+	first := time.Date(2021, 11, 7, 5, 45, 0, 0, time.UTC)
+	for _, want := range []time.Time{first.Add(30 * time.Minute), first.Add(time.Hour)} {
+		next, ok := schedule.Next(first)
+		if !ok || !next.Equal(want) {
+			t.Errorf("clock back, again: Next(%s) = %s, %v, want %s", first, next, ok, want)
+		}
+		first = next
+	}
+
+	for _, s := range []string{"daily 00:00-24:00", "daily 12:00-12:01; daily 12:01-12:00"} {
+		schedule := parseSchedule(t, s, newYork)
+		if next, ok := schedule.Next(time.Now()); ok {
+			t.Errorf("%q: Next() = %s, want no change", s, next)
+		}
+	}
+}
+
+// nextByMinute is the next change found by trying every minute
+func nextByMinute(s *QuietSchedule, t time.Time) (time.Time, bool) {
+	quiet := s.Quiet(t)
+	next := t.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.Quiet(next) != quiet {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestNextMatchesEveryMinute(t *testing.T) {
+	schedules := []string{
+		"mon-thu,sun 22:00-07:00; fri,sat 23:30-09:00",
+		"fri-mon 01:30-02:30 12:00-13:00",
+		"sun 00:00-03:00; sat 02:00-24:00",
+		"daily 02:15-02:45",
+	}
+	for _, name := range []string{"America/New_York", "Europe/Berlin", "Australia/Lord_Howe"} {
+		location := loadLocation(t, name)
+		for _, s := range schedules {
+			schedule := parseSchedule(t, s, location)
+			// every 97 minutes, over the weeks around each change of the
+			// clock
+			for _, from := range []time.Time{
+				time.Date(2021, 3, 8, 0, 0, 0, 0, location),
+				time.Date(2021, 3, 24, 0, 0, 0, 0, location),
+				time.Date(2021, 4, 1, 0, 0, 0, 0, location),
+				time.Date(2021, 10, 1, 0, 0, 0, 0, location),
+				time.Date(2021, 10, 28, 0, 0, 0, 0, location),
+				time.Date(2021, 11, 4, 0, 0, 0, 0, location),
+			} {
+				for at := from; at.Before(from.AddDate(0, 0, 8)); at = at.Add(97 * time.Minute) {
+					got, gotOK := schedule.Next(at)
+					want, wantOK := nextByMinute(schedule, at)
+					if gotOK != wantOK || !got.Equal(want) {
+						t.Errorf("%s %q: Next(%s) = %s, %v, want %s, %v", name, s, at, got, gotOK, want, wantOK)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/skip2/go-qrcode"
+)
+
+// MaxSceneElements is how many elements a /render scene may hold
+const MaxSceneElements = 256
+
+// MaxSceneSize is the largest scene accepted by /render, images included
+const MaxSceneSize = 16 << 20
+
+// MaxSceneImagePixels is how many pixels the images of a scene may take up
+// in all, once scaled to their boxes
+const MaxSceneImagePixels = 4 << 20
+
+// MaxSceneExtent is how far off the screen an element may be placed, and how
+// large it may be. Images and QR codes are made at their size before they are
+// drawn.
+const MaxSceneExtent = 4 * DefaultScreenSize
+
+// Element types of a /render scene
+const (
+	ElementRect      = "rect"
+	ElementRoundRect = "roundrect"
+	ElementLine      = "line"
+	ElementCircle    = "circle"
+	ElementText      = "text"
+	ElementImage     = "image"
+	ElementQR        = "qr"
+	ElementProgress  = "progress"
+)
+
+// Scene is the body of a POST to /render, drawn from the first element to
+// the last over the background
+type Scene struct {
+	Background string     `json:"background,omitempty"`
+	Elements   []*Element `json:"elements"`
+
+	background color.RGBA
+}
+
+// Element is one shape, text, image, QR code or progress bar of a scene.
+// Which fields apply depends on the type.
+type Element struct {
+	Type string `json:"type"`
+	// X and Y are the top left corner, or the centre of a circle
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width,omitempty"`
+	Height float64 `json:"height,omitempty"`
+	// X2 and Y2 are the end of a line
+	X2 float64 `json:"x2,omitempty"`
+	Y2 float64 `json:"y2,omitempty"`
+	// Radius is the radius of a circle or the corners of a roundrect or
+	// progress bar
+	Radius float64 `json:"radius,omitempty"`
+
+	// Color fills shapes and colours lines, text and QR codes
+	Color string `json:"color,omitempty"`
+	// Stroke outlines rects, roundrects and circles
+	Stroke    string  `json:"stroke,omitempty"`
+	LineWidth float64 `json:"lineWidth,omitempty"`
+	// Background is the light colour of a QR code
+	Background string `json:"background,omitempty"`
+	// Track is the unfilled part of a progress bar
+	Track string `json:"track,omitempty"`
+
+	Text string `json:"text,omitempty"`
+	// Font is a family listed by /fonts, the default family if empty
+	Font string `json:"font,omitempty"`
+	// Weight is regular, bold or another weight of the family
+	Weight string  `json:"weight,omitempty"`
+	Size   float64 `json:"size,omitempty"`
+	// Align is left, center or right within the width
+	Align       string  `json:"align,omitempty"`
+	Wrap        bool    `json:"wrap,omitempty"`
+	LineSpacing float64 `json:"lineSpacing,omitempty"`
+
+	// Data is a base64 image, optionally as a data: URL
+	Data string `json:"data,omitempty"`
+	// Fit sizes the image to its width and height like /image does
+	Fit string `json:"fit,omitempty"`
+
+	// Content is the text encoded in a QR code
+	Content string `json:"content,omitempty"`
+
+	// Value and Max fill a progress bar, Max defaults to 100
+	Value float64 `json:"value,omitempty"`
+	Max   float64 `json:"max,omitempty"`
+
+	color, stroke, background, track color.RGBA
+	hasStroke                        bool
+	align                            gg.Align
+	img                              image.Image
+}
+
+// elementValidator collects the problems with one element
+type elementValidator struct {
+	index  int
+	typ    string
+	errors []ElementError
+}
+
+func (v *elementValidator) fail(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, ElementError{Index: v.index, Type: v.typ, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// color parses a hex colour field, falling back to def if it is empty
+func (v *elementValidator) color(field, s, def string) color.RGBA {
+	if s == "" {
+		s = def
+	}
+	c, err := parseHexColor(s)
+	if err != nil {
+		v.fail(field, "%s must be a hex colour", field)
+	}
+	return c
+}
+
+func (v *elementValidator) positive(field string, f float64) {
+	if f <= 0 {
+		v.fail(field, "%s must be greater than 0", field)
+	}
+}
+
+// within checks a position or size is at most MaxSceneExtent either way
+func (v *elementValidator) within(field string, f float64) {
+	if math.Abs(f) > MaxSceneExtent {
+		v.fail(field, "%s must be from -%d to %d", field, MaxSceneExtent, MaxSceneExtent)
+	}
+}
+
+// validate fills in the defaults and checks the element can be drawn.
+// imagePixels counts the pixels of the scene's images so far.
+func (e *Element) validate(index int, imagePixels *int) []ElementError {
+	v := &elementValidator{index: index, typ: e.Type}
+	v.within("x", e.X)
+	v.within("y", e.Y)
+	v.within("width", e.Width)
+	v.within("height", e.Height)
+	v.within("x2", e.X2)
+	v.within("y2", e.Y2)
+	v.within("radius", e.Radius)
+	if e.LineWidth == 0 {
+		e.LineWidth = 1
+	} else if e.LineWidth < 0 {
+		v.fail("lineWidth", "lineWidth must be greater than 0")
+	}
+	if e.Radius < 0 {
+		v.fail("radius", "radius may not be negative")
+	}
+	if e.Stroke != "" {
+		e.stroke = v.color("stroke", e.Stroke, "")
+		e.hasStroke = true
+	}
+
+	switch e.Type {
+	case ElementRect, ElementRoundRect:
+		e.color = v.color("color", e.Color, "ffffff")
+		v.positive("width", e.Width)
+		v.positive("height", e.Height)
+	case ElementLine:
+		e.color = v.color("color", e.Color, "ffffff")
+	case ElementCircle:
+		e.color = v.color("color", e.Color, "ffffff")
+		v.positive("radius", e.Radius)
+	case ElementText:
+		e.color = v.color("color", e.Color, "ffffff")
+		if e.Text == "" {
+			v.fail("text", "text is required")
+		}
+		if e.Size == 0 {
+			e.Size = 16
+		}
+		v.positive("size", e.Size)
+		if e.Size > MaxTextSize {
+			v.fail("size", "size may be at most %d", MaxTextSize)
+		}
+		if e.LineSpacing == 0 {
+			e.LineSpacing = 1.2
+		}
+		v.positive("lineSpacing", e.LineSpacing)
+		if !fonts.has(e.Font) {
+			v.fail("font", "there is no font family %q, GET /fonts lists them", e.Font)
+		}
+		if e.Align == "" {
+			e.align = gg.AlignLeft
+		} else if align, ok := parseTextAlign(e.Align); ok {
+			e.align = align
+		} else {
+			v.fail("align", "align must be left, center or right")
+		}
+		if e.Wrap && e.Width <= 0 {
+			v.fail("width", "wrapped text needs a width")
+		}
+	case ElementImage:
+		switch Fit(e.Fit) {
+		case "":
+			e.Fit = string(FitContain)
+		case FitContain, FitCover, FitStretch, FitNone:
+		default:
+			v.fail("fit", "fit must be contain, cover, stretch or none")
+		}
+		if e.Width < 0 || e.Height < 0 {
+			v.fail("width", "width and height may not be negative")
+		}
+		data := e.Data
+		if i := strings.Index(data, ","); strings.HasPrefix(data, "data:") && i >= 0 {
+			data = data[i+1:]
+		}
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil || len(raw) == 0 {
+			v.fail("data", "data must be a base64 encoded image")
+			break
+		}
+		if len(raw) > MaxImageSize {
+			v.fail("data", "images may be at most %dMB", MaxImageSize>>20)
+			break
+		}
+		img, err := decodeImage(raw, MaxAnimationSide)
+		if err != nil {
+			v.fail("data", "could not decode image, send a PNG, JPEG or GIF: %v", err)
+			break
+		}
+
+		// the image is scaled into its box straight away, so the scene
+		// keeps no more than the box. Without a width or height the box
+		// takes the image's own, up to MaxSceneExtent.
+		box := img.Bounds().Size()
+		if e.Width > 0 {
+			box.X = int(math.Round(e.Width))
+		}
+		if e.Height > 0 {
+			box.Y = int(math.Round(e.Height))
+		}
+		if box.X > MaxSceneExtent {
+			box.X = MaxSceneExtent
+		}
+		if box.Y > MaxSceneExtent {
+			box.Y = MaxSceneExtent
+		}
+		*imagePixels += box.X * box.Y
+		if *imagePixels > MaxSceneImagePixels {
+			v.fail("data", "the images of a scene may take up at most %d pixels", MaxSceneImagePixels)
+			break
+		}
+		layout := DefaultLayout
+		layout.Fit = Fit(e.Fit)
+		layout.Background = color.RGBA{}
+		e.img = layout.Render(img, box)
+	case ElementQR:
+		e.color = v.color("color", e.Color, "000000")
+		e.background = v.color("background", e.Background, "ffffff")
+		if e.Content == "" {
+			v.fail("content", "content is required")
+		}
+		v.positive("width", e.Width)
+	case ElementProgress:
+		e.color = v.color("color", e.Color, "4299e1")
+		e.track = v.color("track", e.Track, "333333")
+		v.positive("width", e.Width)
+		v.positive("height", e.Height)
+		if e.Max == 0 {
+			e.Max = 100
+		}
+		v.positive("max", e.Max)
+	case "":
+		v.fail("type", "type is required")
+	default:
+		v.fail("type", "unknown type %q, use rect, roundrect, line, circle, text, image, qr or progress", e.Type)
+	}
+	return v.errors
+}
+
+// validate fills in the defaults and checks every element, reporting the
+// problems of all invalid elements at once
+func (s *Scene) validate() error {
+	if s.Background == "" {
+		s.Background = "000000"
+	}
+	c, err := parseHexColor(s.Background)
+	if err != nil {
+		return badRequest("invalid_scene", "background must be a hex colour", err)
+	}
+	s.background = c
+	if len(s.Elements) > MaxSceneElements {
+		return badRequest("invalid_scene", fmt.Sprintf("A scene may hold up to %d elements", MaxSceneElements), nil)
+	}
+	var errs []ElementError
+	imagePixels := 0
+	for i, e := range s.Elements {
+		if e == nil {
+			errs = append(errs, ElementError{Index: i, Message: "element is null"})
+			continue
+		}
+		errs = append(errs, e.validate(i, &imagePixels)...)
+	}
+	if len(errs) > 0 {
+		invalid := make(map[int]bool)
+		for _, e := range errs {
+			invalid[e.Index] = true
+		}
+		err := badRequest("invalid_scene", fmt.Sprintf("%d of %d elements are invalid", len(invalid), len(s.Elements)), nil)
+		err.Elements = errs
+		return err
+	}
+	return nil
+}
+
+// render draws a validated scene
+func (s *Scene) render(size int) (*image.RGBA, error) {
+	dc := gg.NewContext(size, size)
+	dc.SetColor(s.background)
+	dc.Clear()
+	for i, e := range s.Elements {
+		if err := e.draw(dc); err != nil {
+			err := internalError("Could not render scene", err)
+			err.Elements = []ElementError{{Index: i, Type: e.Type, Message: err.Detail}}
+			return nil, err
+		}
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(frame, frame.Rect, dc.Image(), image.Point{}, draw.Src)
+	return frame, nil
+}
+
+// fillAndStroke fills the current path and outlines it if the element has
+// a stroke
+func (e *Element) fillAndStroke(dc *gg.Context) {
+	dc.SetColor(e.color)
+	if e.hasStroke {
+		dc.FillPreserve()
+		dc.SetColor(e.stroke)
+		dc.SetLineWidth(e.LineWidth)
+		dc.Stroke()
+		return
+	}
+	dc.Fill()
+}
+
+func (e *Element) draw(dc *gg.Context) error {
+	switch e.Type {
+	case ElementRect:
+		dc.DrawRectangle(e.X, e.Y, e.Width, e.Height)
+		e.fillAndStroke(dc)
+	case ElementRoundRect:
+		dc.DrawRoundedRectangle(e.X, e.Y, e.Width, e.Height, e.Radius)
+		e.fillAndStroke(dc)
+	case ElementCircle:
+		dc.DrawCircle(e.X, e.Y, e.Radius)
+		e.fillAndStroke(dc)
+	case ElementLine:
+		dc.SetColor(e.color)
+		dc.SetLineWidth(e.LineWidth)
+		dc.DrawLine(e.X, e.Y, e.X2, e.Y2)
+		dc.Stroke()
+	case ElementText:
+		if err := setFont(dc, e.Font, e.Weight, e.Size); err != nil {
+			return err
+		}
+		dc.SetColor(e.color)
+		if e.Wrap {
+			dc.DrawStringWrapped(e.Text, e.X, e.Y, 0, 0, e.Width, e.LineSpacing, e.align)
+			break
+		}
+		// without wrapping the text is aligned within the width, if given
+		x, ax := e.X, 0.0
+		switch e.align {
+		case gg.AlignCenter:
+			x, ax = e.X+e.Width/2, 0.5
+		case gg.AlignRight:
+			x, ax = e.X+e.Width, 1
+		}
+		dc.DrawStringAnchored(e.Text, x, e.Y, ax, 1)
+	case ElementImage:
+		// validate already scaled the image into its box
+		dc.DrawImage(e.img, int(math.Round(e.X)), int(math.Round(e.Y)))
+	case ElementQR:
+		q, err := qrcode.New(e.Content, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		q.ForegroundColor = e.color
+		q.BackgroundColor = e.background
+		dc.DrawImage(q.Image(int(math.Round(e.Width))), int(math.Round(e.X)), int(math.Round(e.Y)))
+	case ElementProgress:
+		dc.SetColor(e.track)
+		dc.DrawRoundedRectangle(e.X, e.Y, e.Width, e.Height, e.Radius)
+		dc.Fill()
+		filled := e.Width * math.Max(0, math.Min(1, e.Value/e.Max))
+		if filled > 0 {
+			dc.SetColor(e.color)
+			dc.DrawRoundedRectangle(e.X, e.Y, filled, e.Height, math.Min(e.Radius, filled/2))
+			dc.Fill()
+		}
+	}
+	return nil
+}
+
+// Render draws the JSON scene in the body to the app layer, or the layer
+// given by ?layer=. Invalid scenes are rejected with the problems of every
+// invalid element.
+func (b *PiboxFrameBuffer) Render(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		writeError(w, methodNotAllowed(w, "POST, PUT"))
+		return
+	}
+	query := req.URL.Query()
+	layer, err := queryLayer(query, LayerApp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	priority, err := queryPriority(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	opts, err := parseLayerOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var scene Scene
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MaxSceneSize)).Decode(&scene); err != nil {
+		writeError(w, badRequest("invalid_json", "Send a JSON scene with a list of elements", err))
+		return
+	}
+	if err := scene.validate(); err != nil {
+		writeError(w, err)
+		return
+	}
+	frame, err := scene.render(b.config.screenSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b.player.StopOn(layer)
+	_, err = b.drawLayer(req.Context(), priority, layer, opts, func(l *image.RGBA) {
+		draw.Draw(l, l.Rect, frame, image.Point{}, draw.Src)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Scene drawn\n")
+}
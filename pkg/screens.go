@@ -0,0 +1,265 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/skip2/go-qrcode"
+)
+
+// Colours of the built-in screens
+var (
+	screenBackground = color.RGBA{17, 17, 17, 255}
+	screenText       = color.RGBA{204, 204, 204, 255}
+	screenAccent     = color.RGBA{236, 57, 99, 255}
+)
+
+// screenQRSize is the largest width of the QR code on the built-in screens
+const screenQRSize = 150
+
+// screenTemplate renders a built-in screen from the query of a request
+type screenTemplate func(b *PiboxFrameBuffer, query url.Values) (*image.RGBA, error)
+
+// screenTemplates are the screens served under /screens/
+var screenTemplates = map[string]screenTemplate{
+	"claim": claimScreen,
+	"wifi":  wifiScreen,
+}
+
+// screenLayout is what a built-in screen shows: a title, a QR code and a
+// few lines explaining it
+type screenLayout struct {
+	title   string
+	content string
+	lines   []string
+}
+
+// render draws the screen. It always uses the built-in font, so a screen
+// looks the same on every system.
+func (s screenLayout) render(size int) (*image.RGBA, error) {
+	const family = FallbackFontFamily
+	w := float64(size)
+	dc := gg.NewContext(size, size)
+	dc.SetColor(screenBackground)
+	dc.Clear()
+
+	title := textStyle{family: family, weight: WeightBold, size: 18, lineSpacing: 1, align: gg.AlignCenter, valign: VAlignMiddle, shrink: true}
+	dc.SetColor(screenText)
+	if err := title.drawText(dc, s.title, 8, 6, w-16, 26); err != nil {
+		return nil, err
+	}
+
+	qr := qrOptions{
+		content:   s.content,
+		level:     qrcode.Medium,
+		fg:        color.RGBA{A: 255},
+		bg:        color.RGBA{255, 255, 255, 255},
+		quietZone: DefaultQRQuietZone,
+	}
+	code, err := qr.code(screenQRSize)
+	if err != nil {
+		return nil, err
+	}
+	side := code.Rect.Dx()
+	top := 36 + (screenQRSize-side)/2
+	dc.DrawImage(code, (size-side)/2, top)
+
+	text := textStyle{family: family, weight: WeightRegular, size: 13, lineSpacing: 1.2, align: gg.AlignCenter, valign: VAlignTop, shrink: true}
+	y := float64(36 + screenQRSize + 6)
+	for _, line := range s.lines {
+		if err := text.drawText(dc, line, 8, y, w-16, 16); err != nil {
+			return nil, err
+		}
+		y += 17
+	}
+
+	footer := textStyle{family: family, weight: WeightBold, size: 12, lineSpacing: 1, align: gg.AlignRight, valign: VAlignBottom}
+	dc.SetColor(screenAccent)
+	if err := footer.drawText(dc, "PiBox", 8, w-20, w-16, 16); err != nil {
+		return nil, err
+	}
+	return dc.Image().(*image.RGBA), nil
+}
+
+// claimScreen shows ?url= as a QR code for claiming the device
+func claimScreen(b *PiboxFrameBuffer, query url.Values) (*image.RGBA, error) {
+	raw := query.Get("url")
+	if raw == "" {
+		return nil, badRequest("missing_parameter", "Pass ?url= with the claim URL", nil)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, badRequest("invalid_parameter", "url must be an http or https URL", err)
+	}
+	s := screenLayout{
+		title:   "Claim your PiBox",
+		content: raw,
+		lines:   []string{"Scan the code or visit", u.Host + u.Path},
+	}
+	if v := query.Get("title"); v != "" {
+		s.title = v
+	}
+	return s.render(b.config.screenSize)
+}
+
+// Security types of a Wi-Fi network, as they appear in a WIFI: QR code
+var wifiSecurity = map[string]string{
+	"wpa":    "WPA",
+	"wpa2":   "WPA",
+	"wpa3":   "SAE",
+	"wep":    "WEP",
+	"nopass": "nopass",
+	"open":   "nopass",
+}
+
+// escapeWiFi escapes the characters with a meaning in a WIFI: QR code
+func escapeWiFi(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', ';', ',', ':', '"':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// wifiContent returns the WIFI: QR code that joins a network, as phone
+// cameras understand it
+func wifiContent(ssid, security, password string, hidden bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "WIFI:T:%s;S:%s;", security, escapeWiFi(ssid))
+	if security != "nopass" {
+		fmt.Fprintf(&b, "P:%s;", escapeWiFi(password))
+	}
+	if hidden {
+		b.WriteString("H:true;")
+	}
+	b.WriteString(";")
+	return b.String()
+}
+
+// wifiScreen shows a QR code that joins the network ?ssid=, secured with
+// ?security= and ?password=
+func wifiScreen(b *PiboxFrameBuffer, query url.Values) (*image.RGBA, error) {
+	ssid := query.Get("ssid")
+	if ssid == "" || len(ssid) > 32 {
+		return nil, badRequest("invalid_parameter", "Pass ?ssid= with the network name of up to 32 bytes", nil)
+	}
+	password := query.Get("password")
+	name := strings.ToLower(query.Get("security"))
+	if name == "" {
+		name = "wpa"
+		if password == "" {
+			name = "nopass"
+		}
+	}
+	security, ok := wifiSecurity[name]
+	if !ok {
+		return nil, badRequest("invalid_parameter", "security must be wpa, wpa2, wpa3, wep or nopass", nil)
+	}
+	switch {
+	case security == "nopass" && password != "":
+		return nil, badRequest("invalid_parameter", "An open network has no password", nil)
+	case (security == "WPA" || security == "SAE") && (len(password) < 8 || len(password) > 63):
+		return nil, badRequest("invalid_parameter", "A WPA password is 8 to 63 characters long", nil)
+	case security == "WEP" && password == "":
+		return nil, badRequest("missing_parameter", "Pass ?password= with the WEP key", nil)
+	}
+	hidden := false
+	if v := query.Get("hidden"); v != "" {
+		var err error
+		if hidden, err = strconv.ParseBool(v); err != nil {
+			return nil, badRequest("invalid_parameter", "hidden must be true or false", err)
+		}
+	}
+
+	s := screenLayout{
+		title:   "Join Wi-Fi",
+		content: wifiContent(ssid, security, password, hidden),
+		lines:   []string{"Network: " + ssid},
+	}
+	showPassword := true
+	if v := query.Get("showPassword"); v != "" {
+		var err error
+		if showPassword, err = strconv.ParseBool(v); err != nil {
+			return nil, badRequest("invalid_parameter", "showPassword must be true or false", err)
+		}
+	}
+	if security == "nopass" {
+		s.lines = append(s.lines, "Open network")
+	} else if showPassword {
+		s.lines = append(s.lines, "Password: "+password)
+	}
+	if v := query.Get("title"); v != "" {
+		s.title = v
+	}
+	return s.render(b.config.screenSize)
+}
+
+// Screens lists the built-in screens
+func (b *PiboxFrameBuffer) Screens(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+	names := make([]string, 0, len(screenTemplates))
+	for name := range screenTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// Screen draws the built-in screen named in the path of /screens/{name} to
+// the app layer, or the layer given by ?layer=
+func (b *PiboxFrameBuffer) Screen(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/screens/")
+	template, ok := screenTemplates[name]
+	if !ok {
+		writeError(w, newError(http.StatusNotFound, "screen_not_found", fmt.Sprintf("There is no screen %q, GET /screens lists them", name), nil))
+		return
+	}
+	query := req.URL.Query()
+	priority, err := queryPriority(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	layer, err := queryLayer(query, LayerApp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	opts, err := parseLayerOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	frame, err := template(b, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b.player.StopOn(layer)
+	_, err = b.drawLayer(req.Context(), priority, layer, opts, func(l *image.RGBA) {
+		draw.Draw(l, l.Rect, frame, image.Point{}, draw.Src)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Screen drawn\n")
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/kubesail/pibox-framebuffer/st7789"
+)
+
+// Screenshot writes the frame currently on the screen. The format is picked
+// with ?format=png (default), jpeg or rgb565. rgb565 is the raw frame as
+// big-endian 16 bit pixels, row by row, with its size in the X-Width and
+// X-Height headers.
+func (b *PiboxFrameBuffer) Screenshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, methodNotAllowed(w, "GET, HEAD"))
+		return
+	}
+
+	fb, err := readFrameBuffer()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	frame := fb.Snapshot()
+
+	query := req.URL.Query()
+	switch format := query.Get("format"); format {
+	case "", "png":
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, frame)
+	case "jpeg", "jpg":
+		quality := jpeg.DefaultQuality
+		if q := query.Get("quality"); q != "" {
+			quality, err = strconv.Atoi(q)
+			if err != nil || quality < 1 || quality > 100 {
+				writeError(w, badRequest("invalid_parameter", "quality must be between 1 and 100", nil))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		jpeg.Encode(w, frame, &jpeg.Options{Quality: quality})
+	case "rgb565":
+		rect := frame.Bounds()
+		raw := make([]byte, 0, rect.Dx()*rect.Dy()*2)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				c565 := st7789.RGBATo565(frame.RGBAAt(x, y))
+				raw = append(raw, uint8(c565>>8), uint8(c565))
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Width", strconv.Itoa(rect.Dx()))
+		w.Header().Set("X-Height", strconv.Itoa(rect.Dy()))
+		w.Write(raw)
+	default:
+		writeError(w, badRequest("invalid_parameter", fmt.Sprintf("Unknown format %q, use png, jpeg or rgb565", format), nil))
+	}
+}
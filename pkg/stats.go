@@ -0,0 +1,544 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	human "github.com/dustin/go-humanize"
+	"github.com/fogleman/gg"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// Widgets the stats screen can show
+const (
+	WidgetCPU         = "cpu"
+	WidgetMemory      = "mem"
+	WidgetDisk        = "disk"
+	WidgetNetwork     = "net"
+	WidgetTemperature = "temp"
+	WidgetUptime      = "uptime"
+	WidgetLoad        = "load"
+)
+
+// DefaultStatsWidgets are shown from the top of the stats screen down
+var DefaultStatsWidgets = []string{WidgetCPU, WidgetMemory, WidgetDisk, WidgetNetwork}
+
+// DefaultStatsInterval is how often the stats screen is redrawn
+const DefaultStatsInterval = 3 * time.Second
+
+// StatsStartDelay is how long the splash screen is shown before the stats
+// screen replaces it on startup
+const StatsStartDelay = 6 * time.Second
+
+// Threshold colours a metric as a warning from Warn and as critical from
+// Critical
+type Threshold struct {
+	Warn     float64
+	Critical float64
+}
+
+// DefaultStatsThresholds are the thresholds of the metrics that have them.
+// CPU, memory and disk are percentages, temperature is in °C and load is the
+// one minute load average.
+var DefaultStatsThresholds = map[string]Threshold{
+	WidgetCPU:         {Warn: 40, Critical: 70},
+	WidgetMemory:      {Warn: 40, Critical: 70},
+	WidgetDisk:        {Warn: 80, Critical: 90},
+	WidgetTemperature: {Warn: 60, Critical: 75},
+	WidgetLoad:        {Warn: float64(runtime.NumCPU()), Critical: float64(2 * runtime.NumCPU())},
+}
+
+var (
+	statsBackground = color.RGBA{51, 51, 51, 255}
+	statsLabel      = color.RGBA{160, 160, 160, 255}
+	statsValue      = color.RGBA{180, 180, 180, 255}
+	statsDim        = color.RGBA{100, 100, 100, 255}
+	statsBar        = color.RGBA{70, 70, 70, 255}
+	statsOK         = color.RGBA{183, 225, 205, 255}
+	statsWarn       = color.RGBA{252, 232, 178, 255}
+	statsCritical   = color.RGBA{244, 199, 195, 255}
+)
+
+func (t Threshold) color(v float64) color.RGBA {
+	switch {
+	case v >= t.Critical:
+		return statsCritical
+	case v >= t.Warn:
+		return statsWarn
+	}
+	return statsOK
+}
+
+// ParseStatsWidgets parses a comma separated list of widgets
+func ParseStatsWidgets(s string) ([]string, error) {
+	var widgets []string
+	for _, w := range strings.Split(s, ",") {
+		w = strings.TrimSpace(w)
+		switch w {
+		case "":
+		case WidgetCPU, WidgetMemory, WidgetDisk, WidgetNetwork, WidgetTemperature, WidgetUptime, WidgetLoad:
+			widgets = append(widgets, w)
+		default:
+			return nil, fmt.Errorf("unknown stats widget %q", w)
+		}
+	}
+	return widgets, nil
+}
+
+// ParseStatsThresholds parses thresholds written as metric=warn:critical,
+// separated by commas, e.g. "cpu=50:80,temp=65:80"
+func ParseStatsThresholds(s string) (map[string]Threshold, error) {
+	thresholds := make(map[string]Threshold)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		parts := strings.Split(t, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid threshold %q, use metric=warn:critical", t)
+		}
+		if _, ok := DefaultStatsThresholds[parts[0]]; !ok {
+			return nil, fmt.Errorf("metric %q has no threshold", parts[0])
+		}
+		levels := strings.Split(parts[1], ":")
+		if len(levels) != 2 {
+			return nil, fmt.Errorf("invalid threshold %q, use metric=warn:critical", t)
+		}
+		warn, err := strconv.ParseFloat(levels[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", t, err)
+		}
+		critical, err := strconv.ParseFloat(levels[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", t, err)
+		}
+		// a warning above the critical level would turn the metric red
+		// before yellow
+		if warn > critical {
+			return nil, fmt.Errorf("invalid threshold %q, the warning level is above the critical one", t)
+		}
+		thresholds[parts[0]] = Threshold{Warn: warn, Critical: critical}
+	}
+	return thresholds, nil
+}
+
+// statsRunner redraws the stats screen until it is stopped
+type statsRunner struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartStats draws the stats screen to the background layer after delay, and
+// again every stats interval until StopStats is called
+func (b *PiboxFrameBuffer) StartStats(delay time.Duration) {
+	b.stats.mu.Lock()
+	defer b.stats.mu.Unlock()
+	b.stopStatsLocked()
+
+	ctx, cancel := context.WithCancel(withSource(context.Background(), SourceStats))
+	done := make(chan struct{})
+	b.stats.cancel, b.stats.done = cancel, done
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			// quiet hours hold the last stats drawn until they end
+			if b.quiet.paused() {
+				timer.Reset(b.config.statsInterval)
+				continue
+			}
+			if err := b.drawStats(ctx); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Could not draw stats: %v\n", err)
+			}
+			timer.Reset(b.config.statsInterval)
+		}
+	}()
+}
+
+// StopStats stops redrawing the stats screen. The last one drawn stays on
+// the background layer.
+func (b *PiboxFrameBuffer) StopStats() {
+	b.stats.mu.Lock()
+	defer b.stats.mu.Unlock()
+	b.stopStatsLocked()
+}
+
+func (b *PiboxFrameBuffer) stopStatsLocked() {
+	if b.stats.cancel == nil {
+		return
+	}
+	b.stats.cancel()
+	<-b.stats.done
+	b.stats.cancel, b.stats.done = nil, nil
+}
+
+// StatsRunning reports whether the stats screen is being redrawn
+func (b *PiboxFrameBuffer) StatsRunning() bool {
+	b.stats.mu.Lock()
+	defer b.stats.mu.Unlock()
+	return b.stats.cancel != nil
+}
+
+func (b *PiboxFrameBuffer) drawStats(ctx context.Context) error {
+	img, err := b.RenderStats()
+	if err != nil {
+		return err
+	}
+	b.player.StopOn(LayerBackground)
+	_, err = b.drawLayer(ctx, PriorityLow, LayerBackground, layerOptions{}, func(frame *image.RGBA) {
+		draw.Draw(frame, frame.Rect, img, image.Point{}, draw.Src)
+	})
+	return err
+}
+
+// EnableStats starts the stats screen on the background layer. It shows
+// wherever the layers above it leave the screen uncovered.
+func (b *PiboxFrameBuffer) EnableStats(w http.ResponseWriter, req *http.Request) {
+	b.StartStats(0)
+	fmt.Fprintf(w, "Stats on\n")
+}
+
+// DisableStats stops the stats screen and clears the background layer
+func (b *PiboxFrameBuffer) DisableStats(w http.ResponseWriter, req *http.Request) {
+	b.StopStats()
+	if b.layers.remove(LayerBackground) {
+		if err := b.redraw(req.Context(), PriorityNormal); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	fmt.Fprintf(w, "Stats off\n")
+}
+
+type diskSample struct {
+	name        string
+	used, total uint64
+	percent     float64
+}
+
+type interfaceSample struct {
+	name string
+	ipv4 string
+}
+
+// statsSample holds the metrics shown on one stats screen
+type statsSample struct {
+	cpu         float64
+	mem         float64
+	disks       []diskSample
+	interfaces  []interfaceSample
+	temperature float64
+	hasTemp     bool
+	uptime      time.Duration
+	load        float64
+}
+
+// collectStats reads the metrics of the configured widgets
+func (b *PiboxFrameBuffer) collectStats() statsSample {
+	var s statsSample
+	for _, widget := range b.config.statsWidgets {
+		switch widget {
+		case WidgetCPU:
+			if usage, err := cpu.Percent(0, false); err == nil && len(usage) > 0 {
+				s.cpu = usage[0]
+			}
+		case WidgetMemory:
+			if v, err := mem.VirtualMemory(); err == nil {
+				s.mem = v.UsedPercent
+			}
+		case WidgetDisk:
+			s.disks = b.collectDisks()
+		case WidgetNetwork:
+			s.interfaces = b.collectInterfaces()
+		case WidgetTemperature:
+			s.temperature, s.hasTemp = readTemperature()
+		case WidgetUptime:
+			if uptime, err := host.Uptime(); err == nil {
+				s.uptime = time.Duration(uptime) * time.Second
+			}
+		case WidgetLoad:
+			if avg, err := load.Avg(); err == nil {
+				s.load = avg.Load1
+			}
+		}
+	}
+	return s
+}
+
+// collectDisks returns the usage of every disk mounted under the disk mount
+// prefix
+func (b *PiboxFrameBuffer) collectDisks() []diskSample {
+	parts, _ := disk.Partitions(false)
+	seen := make(map[string]bool)
+	var disks []diskSample
+	for _, p := range parts {
+		if !strings.HasPrefix(p.Mountpoint, b.config.diskMountPrefix) || seen[p.Device] {
+			continue
+		}
+		u, err := disk.Usage(p.Mountpoint)
+		if err != nil || u.Total == 0 {
+			continue
+		}
+		seen[p.Device] = true
+		name := filepath.Base(p.Mountpoint)
+		if name == "/" {
+			name = "root"
+		}
+		disks = append(disks, diskSample{
+			name:    name,
+			used:    u.Used,
+			total:   u.Total,
+			percent: u.UsedPercent,
+		})
+	}
+	return disks
+}
+
+// collectInterfaces returns the configured network interfaces, or every
+// interface that is up apart from loopback
+func (b *PiboxFrameBuffer) collectInterfaces() []interfaceSample {
+	all, _ := net.Interfaces()
+	var samples []interfaceSample
+	for _, name := range b.config.statsInterfaces {
+		sample := interfaceSample{name: name}
+		if inter, err := net.InterfaceByName(name); err == nil {
+			sample.ipv4 = interfaceIPv4(inter)
+		}
+		samples = append(samples, sample)
+	}
+	if len(b.config.statsInterfaces) > 0 {
+		return samples
+	}
+	for i := range all {
+		inter := &all[i]
+		if inter.Flags&net.FlagUp == 0 || inter.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		samples = append(samples, interfaceSample{name: inter.Name, ipv4: interfaceIPv4(inter)})
+	}
+	return samples
+}
+
+func interfaceIPv4(inter *net.Interface) string {
+	addrs, _ := inter.Addrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return ""
+}
+
+// readTemperature returns the SoC temperature in °C
+func readTemperature() (float64, bool) {
+	data, err := os.ReadFile("/sys/class/thermal/thermal_zone0/temp")
+	if err != nil {
+		return 0, false
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return float64(milli) / 1000, true
+}
+
+func formatUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// statsTile is a label with a large value below it
+type statsTile struct {
+	label string
+	value string
+	color color.RGBA
+}
+
+// RenderStats collects the metrics and draws the stats screen without
+// showing it
+func (b *PiboxFrameBuffer) RenderStats() (image.Image, error) {
+	return b.renderStats(b.collectStats())
+}
+
+func (b *PiboxFrameBuffer) renderStats(s statsSample) (image.Image, error) {
+	size := float64(b.config.screenSize)
+	margin := size / 24
+	dc := gg.NewContext(b.config.screenSize, b.config.screenSize)
+	dc.SetColor(statsBackground)
+	dc.Clear()
+
+	var textErr error
+	text := func(content string, x, y, fontSize float64, bold bool, ax float64) {
+		if textErr == nil {
+			textErr = loadFont(dc, fontSize, bold)
+		}
+		if textErr == nil {
+			dc.DrawStringAnchored(content, x, y, ax, 0.5)
+		}
+	}
+
+	// fitSize shrinks fontSize until content is at most width wide
+	fitSize := func(content string, width, fontSize float64, bold bool) float64 {
+		for ; fontSize > 12 && textErr == nil; fontSize -= 2 {
+			if textErr = loadFont(dc, fontSize, bold); textErr != nil {
+				break
+			}
+			if w, _ := dc.MeasureString(content); w <= width {
+				break
+			}
+		}
+		return fontSize
+	}
+
+	y := margin / 2
+	// fits reports whether a row of height h fits and claims the space
+	fits := func(h float64) bool {
+		if y+h > size {
+			return false
+		}
+		y += h
+		return true
+	}
+
+	var tiles []statsTile
+	flushTiles := func() {
+		for len(tiles) > 0 {
+			row := tiles
+			if len(row) > 2 {
+				row = row[:2]
+			}
+			tiles = tiles[len(row):]
+			top := y
+			if !fits(66) {
+				continue
+			}
+			width := (size - 2*margin) / float64(len(row))
+			for i, tile := range row {
+				cx := margin + width*(float64(i)+0.5)
+				dc.SetColor(statsLabel)
+				text(tile.label, cx, top+16, 20, false, 0.5)
+				dc.SetColor(tile.color)
+				text(tile.value, cx, top+46, 30, true, 0.5)
+			}
+		}
+	}
+
+	thresholds := b.config.statsThresholds
+	for _, widget := range b.config.statsWidgets {
+		switch widget {
+		case WidgetCPU:
+			tiles = append(tiles, statsTile{"CPU", fmt.Sprintf("%v%%", math.Round(s.cpu)), thresholds[WidgetCPU].color(s.cpu)})
+		case WidgetMemory:
+			tiles = append(tiles, statsTile{"MEM", fmt.Sprintf("%v%%", math.Round(s.mem)), thresholds[WidgetMemory].color(s.mem)})
+		case WidgetTemperature:
+			tile := statsTile{"TEMP", "n/a", statsDim}
+			if s.hasTemp {
+				tile.value = fmt.Sprintf("%v°C", math.Round(s.temperature))
+				tile.color = thresholds[WidgetTemperature].color(s.temperature)
+			}
+			tiles = append(tiles, tile)
+		case WidgetUptime:
+			tiles = append(tiles, statsTile{"UP", formatUptime(s.uptime), statsValue})
+		case WidgetLoad:
+			tiles = append(tiles, statsTile{"LOAD", fmt.Sprintf("%.2f", s.load), thresholds[WidgetLoad].color(s.load)})
+
+		case WidgetDisk:
+			flushTiles()
+			if len(s.disks) == 0 {
+				top := y
+				if fits(48) {
+					dc.SetColor(statsLabel)
+					text("No SSD configured", size/2, top+24, 22, false, 0.5)
+				}
+			}
+			for _, d := range s.disks {
+				top := y
+				if !fits(48) {
+					break
+				}
+				barWidth := size - 2*margin
+				// outline, inside and usage
+				dc.DrawRoundedRectangle(margin, top+4, barWidth, 40, 5)
+				dc.SetColor(statsLabel)
+				dc.Fill()
+				dc.DrawRoundedRectangle(margin+1, top+5, barWidth-2, 38, 4)
+				dc.SetColor(statsBackground)
+				dc.Fill()
+				if d.percent > 0 {
+					dc.DrawRoundedRectangle(margin+1, top+5, (d.percent/100)*(barWidth-2), 38, 4)
+					dc.SetColor(statsBar)
+					dc.Fill()
+				}
+				label := fmt.Sprintf("%s / %s", human.Bytes(d.used), human.Bytes(d.total))
+				if len(s.disks) > 1 {
+					label = d.name + " " + label
+				}
+				dc.SetColor(statsLabel)
+				if d.percent >= thresholds[WidgetDisk].Warn {
+					dc.SetColor(thresholds[WidgetDisk].color(d.percent))
+				}
+				text(label, size/2, top+24, fitSize(label, barWidth-12, 20, false), false, 0.5)
+			}
+
+		case WidgetNetwork:
+			flushTiles()
+			for _, inter := range s.interfaces {
+				top := y
+				if !fits(30) {
+					break
+				}
+				dc.SetColor(statsLabel)
+				text(inter.name, margin, top+15, 20, false, 0)
+				nameWidth, _ := dc.MeasureString(inter.name)
+				if inter.ipv4 == "" {
+					dc.SetColor(statsDim)
+					text("Disconnected", size-margin, top+15, 20, true, 1)
+					continue
+				}
+				// shrink long addresses to fit next to the name
+				fontSize := fitSize(inter.ipv4, size-3*margin-nameWidth, 24, true)
+				dc.SetColor(statsValue)
+				text(inter.ipv4, size-margin, top+15, fontSize, true, 1)
+			}
+		}
+	}
+	flushTiles()
+
+	if textErr != nil {
+		return nil, textErr
+	}
+	return dc.Image(), nil
+}
@@ -0,0 +1,283 @@
+package pkg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/fogleman/gg"
+)
+
+// MinTextSize is the smallest size shrink-to-fit text is drawn at
+const MinTextSize = 6
+
+// MaxTextSize is the largest size text may be drawn at, about the height of
+// the screen. A font face caches glyph masks sized by it, so anything larger
+// costs memory without fitting anyway.
+const MaxTextSize = DefaultScreenSize
+
+// Vertical alignments of text within its box
+const (
+	VAlignTop    = "top"
+	VAlignMiddle = "middle"
+	VAlignBottom = "bottom"
+)
+
+// textStyle is how a block of text is laid out within a box
+type textStyle struct {
+	family      string
+	weight      string
+	size        float64
+	lineSpacing float64
+	align       gg.Align
+	valign      string
+	// shrink makes the text smaller until it fits the box
+	shrink bool
+}
+
+// defaultTextStyle is centred, bold text in the default family
+var defaultTextStyle = textStyle{
+	weight:      WeightBold,
+	size:        22,
+	lineSpacing: 1.5,
+	align:       gg.AlignCenter,
+	valign:      VAlignMiddle,
+}
+
+// parseTextAlign parses left, center or right
+func parseTextAlign(s string) (gg.Align, bool) {
+	switch s {
+	case "left":
+		return gg.AlignLeft, true
+	case "center":
+		return gg.AlignCenter, true
+	case "right":
+		return gg.AlignRight, true
+	}
+	return gg.AlignLeft, false
+}
+
+// parseTextStyle reads ?font=, ?weight=, ?size=, ?lineSpacing=, ?align=,
+// ?valign= and ?shrink=, falling back to defaultTextStyle
+func parseTextStyle(query url.Values) (textStyle, error) {
+	s := defaultTextStyle
+	if family := query.Get("font"); family != "" {
+		if !fonts.has(family) {
+			return s, unknownFont(family)
+		}
+		s.family = family
+	}
+	if weight := query.Get("weight"); weight != "" {
+		s.weight = weight
+	}
+	if v := query.Get("size"); v != "" {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil || size <= 0 || size > MaxTextSize {
+			return s, badRequest("invalid_parameter", fmt.Sprintf("size must be a positive number up to %d", MaxTextSize), err)
+		}
+		s.size = size
+	}
+	if v := query.Get("lineSpacing"); v != "" {
+		spacing, err := strconv.ParseFloat(v, 64)
+		if err != nil || spacing <= 0 {
+			return s, badRequest("invalid_parameter", "lineSpacing must be a positive number", err)
+		}
+		s.lineSpacing = spacing
+	}
+	if v := query.Get("align"); v != "" {
+		align, ok := parseTextAlign(v)
+		if !ok {
+			return s, badRequest("invalid_parameter", "align must be left, center or right", nil)
+		}
+		s.align = align
+	}
+	switch v := query.Get("valign"); v {
+	case "":
+	case VAlignTop, VAlignMiddle, VAlignBottom:
+		s.valign = v
+	default:
+		return s, badRequest("invalid_parameter", "valign must be top, middle or bottom", nil)
+	}
+	if v := query.Get("shrink"); v != "" {
+		shrink, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, badRequest("invalid_parameter", "shrink must be true or false", err)
+		}
+		s.shrink = shrink
+	}
+	return s, nil
+}
+
+// drawText wraps text to the width of the box x, y, w, h and draws it
+// aligned within the box, shrinking it first if the style says so
+func (s textStyle) drawText(dc *gg.Context, text string, x, y, w, h float64) error {
+	var lines []string
+	var height float64
+	layout := func(size float64) (bool, error) {
+		if err := setFont(dc, s.family, s.weight, size); err != nil {
+			return false, err
+		}
+		lines = dc.WordWrap(text, w)
+		height = textHeight(dc, len(lines), s.lineSpacing)
+		return height <= h && widest(dc, lines) <= w, nil
+	}
+	fits, err := layout(s.size)
+	if err != nil {
+		return err
+	}
+	if s.shrink && !fits && s.size > MinTextSize {
+		// the sizes tried are 1pt apart down to MinTextSize, which is drawn
+		// whether it fits or not. Smaller text fits at least as well, so
+		// search for the largest size that fits.
+		steps := int(math.Ceil(s.size - MinTextSize))
+		size := func(step int) float64 {
+			return math.Max(s.size-float64(step), MinTextSize)
+		}
+		lo, hi := 1, steps
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if fits, err = layout(size(mid)); err != nil {
+				return err
+			}
+			if fits {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		if _, err := layout(size(lo)); err != nil {
+			return err
+		}
+	}
+	top := y
+	switch s.valign {
+	case VAlignMiddle:
+		top = y + (h-height)/2
+	case VAlignBottom:
+		top = y + h - height
+	}
+	dc.DrawStringWrapped(text, x, top, 0, 0, w, s.lineSpacing, s.align)
+	return nil
+}
+
+// textHeight is the height of n lines the way gg.DrawStringWrapped lays
+// them out
+func textHeight(dc *gg.Context, n int, lineSpacing float64) float64 {
+	h := dc.FontHeight()
+	return float64(n)*h*lineSpacing - (lineSpacing-1)*h
+}
+
+// widest returns the width of the longest line, which is wider than the
+// box when a single word does not fit
+func widest(dc *gg.Context, lines []string) float64 {
+	max := 0.0
+	for _, line := range lines {
+		if w, _ := dc.MeasureString(line); w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// renderText draws text in the box given by ?x=, ?y=, ?width= and ?height=,
+// the whole screen by default. ?color= and ?background= default to fg and
+// bg, where an empty bg is transparent.
+func (b *PiboxFrameBuffer) renderText(text string, query url.Values, fg, bg string) (*image.RGBA, error) {
+	style, err := parseTextStyle(query)
+	if err != nil {
+		return nil, err
+	}
+	textColor, err := parseHexColor(fg)
+	if err != nil {
+		return nil, badRequest("invalid_parameter", "color must be a hex colour", err)
+	}
+	if v := query.Get("color"); v != "" {
+		if textColor, err = parseHexColor(v); err != nil {
+			return nil, badRequest("invalid_parameter", "color must be a hex colour", err)
+		}
+	}
+	var background color.RGBA
+	if v := query.Get("background"); v != "" {
+		bg = v
+	}
+	if bg != "" {
+		if background, err = parseHexColor(bg); err != nil {
+			return nil, badRequest("invalid_parameter", "background must be a hex colour", err)
+		}
+	}
+	screen := b.config.screenSize
+	x, err := queryInt(query, "x", 0)
+	if err != nil {
+		return nil, err
+	}
+	y, err := queryInt(query, "y", 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := queryInt(query, "width", screen-x)
+	if err != nil {
+		return nil, err
+	}
+	h, err := queryInt(query, "height", screen-y)
+	if err != nil {
+		return nil, err
+	}
+	if w <= 0 || h <= 0 {
+		return nil, badRequest("invalid_parameter", fmt.Sprintf("The text box %dx%d at %d,%d is empty", w, h, x, y), nil)
+	}
+
+	dc := gg.NewContext(screen, screen)
+	dc.SetColor(background)
+	dc.Clear()
+	dc.SetColor(textColor)
+	if err := style.drawText(dc, text, float64(x), float64(y), float64(w), float64(h)); err != nil {
+		return nil, err
+	}
+	return dc.Image().(*image.RGBA), nil
+}
+
+// TextRequest draws ?content= to the app layer, or the layer given by
+// ?layer=
+func (b *PiboxFrameBuffer) TextRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	content := query.Get("content")
+	if content == "" {
+		writeError(w, badRequest("missing_parameter", "Pass ?content= with the text to draw", nil))
+		return
+	}
+	priority, err := queryPriority(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	layer, err := queryLayer(query, LayerApp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	opts, err := parseLayerOptions(query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	frame, err := b.renderText(content, query, "cccccc", "")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b.player.StopOn(layer)
+	_, err = b.drawLayer(req.Context(), priority, layer, opts, func(l *image.RGBA) {
+		draw.Draw(l, l.Rect, frame, image.Point{}, draw.Src)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Text drawn\n")
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// TransferStats is the response of /stats
+type TransferStats struct {
+	Frames     uint64 `json:"frames"`
+	Regions    uint64 `json:"regions"`
+	BytesSent  uint64 `json:"bytesSent"`
+	BytesSaved uint64 `json:"bytesSaved"`
+
+	// Queued is how many draws are waiting for the display, Coalesced how
+	// many were dropped because a newer frame replaced them first
+	Queued    int    `json:"queued"`
+	Coalesced uint64 `json:"coalesced"`
+
+	// FontCache reports how often text was drawn with a cached font face
+	FontCache FontCacheStats `json:"fontCache"`
+}
+
+// DisplayStats reports how much pixel data was sent to the panel, and how
+// much was skipped because only the changed parts of each frame are sent
+func (b *PiboxFrameBuffer) DisplayStats(w http.ResponseWriter, req *http.Request) {
+	fb, err := readFrameBuffer()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s := fb.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TransferStats{
+		Frames:     s.Frames,
+		Regions:    s.Regions,
+		BytesSent:  s.BytesSent,
+		BytesSaved: s.BytesSaved,
+		Queued:     b.queue.Len(),
+		Coalesced:  b.queue.Coalesced(),
+		FontCache:  fonts.faces.Stats(),
+	})
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+var errInvalidWebP = errors.New("invalid WebP")
+
+// decodeWebP decodes a still or animated WebP. x/image/webp only reads
+// still images, so each ANMF frame's ALPH and VP8/VP8L chunks are rewrapped
+// as a standalone file.
+func decodeWebP(data []byte, budget *animationBudget) (image.Point, []animationFrame, int, error) {
+	var (
+		size     image.Point
+		frames   []animationFrame
+		animated bool
+		plays    int
+		count    int
+	)
+	// the frames are counted before any is decoded
+	err := webpChunks(data[12:], func(id string, payload []byte) error {
+		if id == "ANMF" {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	if err := budget.frames(count); err != nil {
+		return image.Point{}, nil, 0, err
+	}
+	err = webpChunks(data[12:], func(id string, payload []byte) error {
+		switch id {
+		case "VP8X":
+			if len(payload) < 10 {
+				return errInvalidWebP
+			}
+			animated = payload[0]&0x02 != 0
+			size = image.Pt(int(le24(payload[4:]))+1, int(le24(payload[7:]))+1)
+			if err := checkAnimationSize("canvas", int64(size.X), int64(size.Y)); err != nil {
+				return err
+			}
+		case "ANIM":
+			if len(payload) < 6 {
+				return errInvalidWebP
+			}
+			plays = int(binary.LittleEndian.Uint16(payload[4:]))
+		case "ANMF":
+			if len(payload) < 16 {
+				return errInvalidWebP
+			}
+			x, y := int(le24(payload[0:]))*2, int(le24(payload[3:]))*2
+			w, h := int(le24(payload[6:]))+1, int(le24(payload[9:]))+1
+			if err := checkAnimationSize("frame", int64(w), int64(h)); err != nil {
+				return err
+			}
+			// frames with alpha decode to the most, 4 bytes a pixel
+			if err := budget.decode(int64(w), int64(h), 4); err != nil {
+				return err
+			}
+			img, err := decodeWebPFrame(payload[16:], w, h)
+			if err != nil {
+				return err
+			}
+			flags := payload[15]
+			frame := animationFrame{
+				img:   img,
+				rect:  image.Rect(x, y, x+w, y+h),
+				delay: time.Duration(le24(payload[12:])) * time.Millisecond,
+				blend: flags&0x02 == 0,
+			}
+			if flags&0x01 != 0 {
+				frame.dispose = disposeBackground
+			}
+			frames = append(frames, frame)
+		}
+		return nil
+	})
+	if err != nil {
+		return image.Point{}, nil, 0, err
+	}
+
+	if !animated {
+		config, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		if err := checkAnimationSize("image", int64(config.Width), int64(config.Height)); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		if err := budget.frames(1); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		if err := budget.decode(int64(config.Width), int64(config.Height), 4); err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return image.Point{}, nil, 0, err
+		}
+		return img.Bounds().Size(), []animationFrame{{img: img, rect: img.Bounds()}}, 1, nil
+	}
+	return size, frames, plays, nil
+}
+
+// decodeWebPFrame decodes the image chunks of an ANMF frame
+func decodeWebPFrame(data []byte, w, h int) (image.Image, error) {
+	var alpha, bitstream []byte
+	err := webpChunks(data, func(id string, payload []byte) error {
+		switch id {
+		case "ALPH":
+			alpha = payload
+		case "VP8 ", "VP8L":
+			bitstream = webpChunk(id, payload)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bitstream == nil {
+		return nil, errInvalidWebP
+	}
+	// the bitstream has a size of its own, which the frame's was checked in
+	// place of
+	config, err := webp.DecodeConfig(bytes.NewReader(webpFile(bitstream)))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width != w || config.Height != h {
+		return nil, errInvalidWebP
+	}
+
+	var chunks []byte
+	if alpha != nil {
+		header := make([]byte, 10)
+		header[0] = 0x10 // alpha
+		putLE24(header[4:], uint32(w-1))
+		putLE24(header[7:], uint32(h-1))
+		chunks = append(chunks, webpChunk("VP8X", header)...)
+		chunks = append(chunks, webpChunk("ALPH", alpha)...)
+	}
+	chunks = append(chunks, bitstream...)
+	return webp.Decode(bytes.NewReader(webpFile(chunks)))
+}
+
+// webpFile wraps chunks in a RIFF header
+func webpFile(chunks []byte) []byte {
+	file := make([]byte, 12, 12+len(chunks))
+	copy(file, "RIFF")
+	binary.LittleEndian.PutUint32(file[4:], uint32(4+len(chunks)))
+	copy(file[8:], "WEBP")
+	return append(file, chunks...)
+}
+
+// webpChunks calls fn for each RIFF chunk in data
+func webpChunks(data []byte, fn func(id string, payload []byte) error) error {
+	for o := 0; o+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[o+4:]))
+		if n < 0 || o+8+n > len(data) {
+			return errInvalidWebP
+		}
+		if err := fn(string(data[o:o+4]), data[o+8:o+8+n]); err != nil {
+			return err
+		}
+		// chunks are padded to an even size
+		o += 8 + n + n&1
+	}
+	return nil
+}
+
+func webpChunk(id string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload)+1)
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)&1 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func le24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putLE24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,300 @@
+package st7789
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/kubesail/pibox-framebuffer/metrics"
+)
+
+// Stats counts the pixel data sent to the panel
+type Stats struct {
+	Frames     uint64 // frames drawn with DrawRAW
+	Regions    uint64 // address windows written
+	BytesSent  uint64 // pixel bytes sent over SPI
+	BytesSaved uint64 // pixel bytes skipped because the panel already showed them
+
+	Transfers      uint64 // SPI transfers made by SendData and SendCommand
+	TransferErrors uint64 // SPI transfers that failed
+
+	Convert  metrics.HistogramSnapshot // seconds spent converting a frame or region to RGB565
+	Transfer metrics.HistogramSnapshot // seconds spent sending a frame's or region's pixels
+}
+
+const (
+	// maxTxSize is the largest SPI transfer the kernel driver accepts
+	maxTxSize = 4096
+	// tileSize is the granularity, in pixels, of the search for changes
+	tileSize = 16
+	// maxDirtyRects is the number of windows above which a frame is sent as
+	// a single window covering all of the changes
+	maxDirtyRects = 16
+)
+
+// The device keeps a copy of the panel memory so that DrawRAW only sends what
+// changed. Memory is laid out as big-endian RGB565, one memory row after the
+// other. Rectangles in memory coordinates use X for columns and Y for rows.
+
+func (d *Device) memorySize() (cols, rows int) {
+	return int(d.height), int(d.width)
+}
+
+func (d *Device) ensureBuffers() {
+	cols, rows := d.memorySize()
+	if len(d.frame) != cols*rows*2 {
+		d.frame = make([]byte, cols*rows*2)
+		d.next = make([]byte, cols*rows*2)
+		d.frameValid = false
+	}
+}
+
+// memoryRect maps a rectangle in image coordinates to panel memory. Image
+// column x is memory row width-1-x and image row y is memory column y.
+func (d *Device) memoryRect(rect image.Rectangle) image.Rectangle {
+	w := int(d.width)
+	return image.Rect(rect.Min.Y, w-rect.Max.X, rect.Max.Y, w-rect.Min.X)
+}
+
+// rgb565 packs 8 bit colour channels the way RGBATo565 does
+func rgb565(r, g, b uint8) uint16 {
+	return uint16(r&0xF8)<<8 | uint16(g&0xFC)<<3 | uint16(b>>3)
+}
+
+// convert writes the pixels of img into the memory buffer buf. rect is in
+// image coordinates and src is the point of img drawn at rect.Min. The common
+// image types are read directly, without allocating or going through
+// image.Image's At.
+func (d *Device) convert(buf []byte, rect image.Rectangle, img image.Image, src image.Point) {
+	cols, _ := d.memorySize()
+	w := int(d.width)
+	dx, dy := src.X-rect.Min.X, src.Y-rect.Min.Y
+
+	// pixels are written in memory order: a memory row is an image column
+	put := func(x, y int, c uint16) {
+		i := ((w-1-x)*cols + y) * 2
+		buf[i] = uint8(c >> 8)
+		buf[i+1] = uint8(c)
+	}
+
+	typed := img
+	if !rect.Add(image.Pt(dx, dy)).In(img.Bounds()) {
+		// only At knows what lies outside an image's bounds
+		typed = nil
+	}
+
+	switch m := typed.(type) {
+	case *image.RGBA:
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := m.PixOffset(x+dx, rect.Min.Y+dy)
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				// premultiplied, the panel shows the colour over black
+				put(x, y, rgb565(m.Pix[p], m.Pix[p+1], m.Pix[p+2]))
+				p += m.Stride
+			}
+		}
+	case *image.NRGBA:
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := m.PixOffset(x+dx, rect.Min.Y+dy)
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				// premultiply the same way color.NRGBA does
+				a := uint32(m.Pix[p+3]) * 0x101
+				r := uint32(m.Pix[p]) * 0x101 * a / 0xFFFF
+				g := uint32(m.Pix[p+1]) * 0x101 * a / 0xFFFF
+				b := uint32(m.Pix[p+2]) * 0x101 * a / 0xFFFF
+				put(x, y, rgb565(uint8(r>>8), uint8(g>>8), uint8(b>>8)))
+				p += m.Stride
+			}
+		}
+	case *image.YCbCr:
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				yi := m.YOffset(x+dx, y+dy)
+				ci := m.COffset(x+dx, y+dy)
+				r, g, b := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+				put(x, y, rgb565(r, g, b))
+			}
+		}
+	case *image.Paletted:
+		var palette [256]uint16
+		for i, c := range m.Palette {
+			if i == len(palette) {
+				break
+			}
+			r, g, b, _ := c.RGBA()
+			palette[i] = rgb565(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+		}
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				put(x, y, palette[m.Pix[m.PixOffset(x+dx, y+dy)]])
+			}
+		}
+	default:
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				r, g, b, _ := img.At(x+dx, y+dy).RGBA()
+				put(x, y, rgb565(uint8(r>>8), uint8(g>>8), uint8(b>>8)))
+			}
+		}
+	}
+}
+
+// sendMemory writes the memory rectangle m of buf to the panel
+func (d *Device) sendMemory(buf []byte, m image.Rectangle) error {
+	if err := d.setWindow(int16(m.Min.X), int16(m.Max.X-1), int16(m.Min.Y), int16(m.Max.Y-1)); err != nil {
+		return err
+	}
+	cols, _ := d.memorySize()
+	rowBytes := cols * 2
+	var data []byte
+	if m.Min.X == 0 && m.Max.X == cols {
+		// whole rows are contiguous in the buffer
+		data = buf[m.Min.Y*rowBytes : m.Max.Y*rowBytes]
+	} else {
+		data = d.scratch[:0]
+		for row := m.Min.Y; row < m.Max.Y; row++ {
+			data = append(data, buf[row*rowBytes+m.Min.X*2:row*rowBytes+m.Max.X*2]...)
+		}
+		d.scratch = data
+	}
+	if err := d.sendPixels(data); err != nil {
+		return err
+	}
+	d.statsMu.Lock()
+	d.stats.Regions++
+	d.stats.BytesSent += uint64(len(data))
+	d.statsMu.Unlock()
+	return nil
+}
+
+// sendPixels sends pixel data in transfers the SPI driver accepts
+func (d *Device) sendPixels(data []byte) error {
+	for i := 0; i < len(data); i += maxTxSize {
+		end := i + maxTxSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := d.SendData(data[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns how much pixel data has been sent to the panel, and how long
+// converting and sending it took
+func (d *Device) Stats() Stats {
+	d.statsMu.Lock()
+	s := d.stats
+	d.statsMu.Unlock()
+	s.Convert = d.convertTime.Snapshot()
+	s.Transfer = d.transferTime.Snapshot()
+	return s
+}
+
+// rectScratch holds the slices dirtyRects builds its result in, reused from
+// one frame to the next
+type rectScratch struct {
+	done, open, band, extended []image.Rectangle
+}
+
+// dirtyRects returns the memory rectangles that differ between prev and
+// next. Changed tiles are merged into horizontal runs, runs spanning the same
+// columns in consecutive bands are merged vertically, and each rectangle is
+// then shrunk to the pixels that actually changed. The result is only valid
+// until the next call with the same scratch.
+func dirtyRects(prev, next []byte, cols, rows int, scratch *rectScratch) []image.Rectangle {
+	done, open := scratch.done[:0], scratch.open[:0]
+	for y0 := 0; y0 < rows; y0 += tileSize {
+		y1 := y0 + tileSize
+		if y1 > rows {
+			y1 = rows
+		}
+
+		band := scratch.band[:0]
+		start := -1
+		for x0 := 0; x0 < cols; x0 += tileSize {
+			x1 := x0 + tileSize
+			if x1 > cols {
+				x1 = cols
+			}
+			if changed(prev, next, cols, image.Rect(x0, y0, x1, y1)) {
+				if start < 0 {
+					start = x0
+				}
+				continue
+			}
+			if start >= 0 {
+				band = append(band, image.Rect(start, y0, x0, y1))
+				start = -1
+			}
+		}
+		if start >= 0 {
+			band = append(band, image.Rect(start, y0, cols, y1))
+		}
+
+		scratch.band = band
+		extended := scratch.extended[:0]
+		for _, r := range band {
+			merged := false
+			for i, o := range open {
+				if !o.Empty() && o.Min.X == r.Min.X && o.Max.X == r.Max.X {
+					extended = append(extended, o.Union(r))
+					open[i] = image.Rectangle{}
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				extended = append(extended, r)
+			}
+		}
+		for _, o := range open {
+			if !o.Empty() {
+				done = append(done, o)
+			}
+		}
+		// the rectangles left open become the ones extended next
+		open, scratch.extended = extended, open
+	}
+	done = append(done, open...)
+	scratch.open = open
+
+	for i, r := range done {
+		done[i] = shrink(prev, next, cols, r)
+	}
+	if len(done) > maxDirtyRects {
+		bounds := done[0]
+		for _, r := range done[1:] {
+			bounds = bounds.Union(r)
+		}
+		done = append(done[:0], bounds)
+	}
+	scratch.done = done
+	return done
+}
+
+// changed reports whether any pixel in the memory rectangle r differs
+func changed(prev, next []byte, cols int, r image.Rectangle) bool {
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		a := (row*cols + r.Min.X) * 2
+		b := (row*cols + r.Max.X) * 2
+		if string(prev[a:b]) != string(next[a:b]) {
+			return true
+		}
+	}
+	return false
+}
+
+// shrink returns the bounding box of the changed pixels in r
+func shrink(prev, next []byte, cols int, r image.Rectangle) image.Rectangle {
+	bounds := image.Rectangle{}
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		for col := r.Min.X; col < r.Max.X; col++ {
+			i := (row*cols + col) * 2
+			if prev[i] != next[i] || prev[i+1] != next[i+1] {
+				bounds = bounds.Union(image.Rect(col, row, col+1, row+1))
+			}
+		}
+	}
+	return bounds
+}
@@ -0,0 +1,225 @@
+package st7789
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"testing"
+
+	"periph.io/x/conn/v3"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpiotest"
+)
+
+// fakeConn stands in for the SPI connection. It keeps a copy of each data
+// transfer, the ones made with the data/command pin high, while record is set.
+type fakeConn struct {
+	dc     *gpiotest.Pin
+	record bool
+	data   [][]byte
+}
+
+func (c *fakeConn) String() string      { return "fake" }
+func (c *fakeConn) Duplex() conn.Duplex { return conn.Half }
+
+func (c *fakeConn) Tx(w, r []byte) error {
+	if c.record && c.dc.Read() == gpio.High {
+		c.data = append(c.data, append([]byte(nil), w...))
+	}
+	return nil
+}
+
+func newTestDevice(tb testing.TB) (*Device, *fakeConn) {
+	dc := &gpiotest.Pin{N: "DC"}
+	c := &fakeConn{dc: dc}
+	d, err := newDev(c, &Opts{W: 240, H: 240}, dc)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d, c
+}
+
+// testImages returns a 240x240 frame of each type convert reads directly,
+// shifted by seed so that frames with different seeds differ everywhere
+func testImages(seed int) map[string]image.Image {
+	rect := image.Rect(0, 0, 240, 240)
+	rgba := image.NewRGBA(rect)
+	nrgba := image.NewNRGBA(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	paletted := image.NewPaletted(rect, palette.Plan9)
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 240; x++ {
+			v := uint8(x + y + seed)
+			rgba.SetRGBA(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{v, v / 2, 255 - v, uint8(x)})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = v
+			ycbcr.Cb[ycbcr.COffset(x, y)] = v / 2
+			ycbcr.Cr[ycbcr.COffset(x, y)] = 255 - v
+			paletted.SetColorIndex(x, y, v)
+		}
+	}
+	return map[string]image.Image{
+		"RGBA":     rgba,
+		"NRGBA":    nrgba,
+		"YCbCr":    ycbcr,
+		"Paletted": paletted,
+	}
+}
+
+// opaque hides the type of an image, so convert has to go through At
+type opaque struct{ image.Image }
+
+func TestConvertMatchesAt(t *testing.T) {
+	d, _ := newTestDevice(t)
+	d.ensureBuffers()
+	for name, img := range testImages(0) {
+		d.convert(d.frame, d.rect, img, img.Bounds().Min)
+		d.convert(d.next, d.rect, opaque{img}, img.Bounds().Min)
+		if !bytes.Equal(d.frame, d.next) {
+			t.Errorf("%s: converted differently than through At", name)
+		}
+	}
+}
+
+func TestConvertAllocs(t *testing.T) {
+	d, _ := newTestDevice(t)
+	d.ensureBuffers()
+	for name, img := range testImages(0) {
+		allocs := testing.AllocsPerRun(10, func() {
+			d.convert(d.next, d.rect, img, img.Bounds().Min)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per frame, want 0", name, allocs)
+		}
+	}
+}
+
+func TestDrawRAWAllocs(t *testing.T) {
+	d, _ := newTestDevice(t)
+	frames := []image.Image{testImages(0)["RGBA"], testImages(128)["RGBA"]}
+	// the first frame allocates the buffers
+	if err := d.DrawRAW(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	allocs := testing.AllocsPerRun(10, func() {
+		i++
+		if err := d.DrawRAW(frames[i%2]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per full frame, want 0", allocs)
+	}
+}
+
+func TestDrawRAWSendsLastChunk(t *testing.T) {
+	d, c := newTestDevice(t)
+	img := testImages(0)["RGBA"]
+	c.record = true
+	if err := d.DrawRAW(img); err != nil {
+		t.Fatal(err)
+	}
+
+	// the window's columns and rows come first, then the pixels
+	if len(c.data) < 3 {
+		t.Fatalf("%d data transfers, want the window and the pixels", len(c.data))
+	}
+	pixels := c.data[2:]
+	const frameSize = 240 * 240 * 2
+	want := frameSize/maxTxSize + 1
+	if len(pixels) != want {
+		t.Fatalf("%d pixel transfers, want %d", len(pixels), want)
+	}
+	for i, p := range pixels[:len(pixels)-1] {
+		if len(p) != maxTxSize {
+			t.Errorf("transfer %d is %d bytes, want %d", i, len(p), maxTxSize)
+		}
+	}
+	last := pixels[len(pixels)-1]
+	if len(last) != frameSize%maxTxSize {
+		t.Errorf("last transfer is %d bytes, want %d", len(last), frameSize%maxTxSize)
+	}
+	if !bytes.Equal(bytes.Join(pixels, nil), d.frame) {
+		t.Error("the pixels sent differ from the frame drawn")
+	}
+}
+
+func TestDrawRAWSendsOnlyChanges(t *testing.T) {
+	d, c := newTestDevice(t)
+	img := image.NewRGBA(image.Rect(0, 0, 240, 240))
+	if err := d.DrawRAW(img); err != nil {
+		t.Fatal(err)
+	}
+	// the scratch space is reused, so the second change checks it starts
+	// over
+	for _, block := range []image.Rectangle{image.Rect(20, 30, 30, 40), image.Rect(200, 5, 203, 9)} {
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			for x := block.Min.X; x < block.Max.X; x++ {
+				img.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			}
+		}
+		c.data, c.record = nil, true
+		if err := d.DrawRAW(img); err != nil {
+			t.Fatal(err)
+		}
+		c.record = false
+
+		// the window's columns, its rows and then its pixels
+		if len(c.data) != 3 {
+			t.Fatalf("%v: %d data transfers, want 3", block, len(c.data))
+		}
+		if got, want := len(c.data[2]), block.Dx()*block.Dy()*2; got != want {
+			t.Errorf("%v: sent %d bytes, want %d", block, got, want)
+		}
+	}
+}
+
+func BenchmarkConvert(b *testing.B) {
+	for name, img := range testImages(0) {
+		img := img
+		b.Run(name, func(b *testing.B) {
+			d, _ := newTestDevice(b)
+			d.ensureBuffers()
+			b.SetBytes(int64(len(d.next)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.convert(d.next, d.rect, img, img.Bounds().Min)
+			}
+		})
+	}
+}
+
+func BenchmarkDrawRAW(b *testing.B) {
+	even, odd := testImages(0), testImages(128)
+	for _, name := range []string{"RGBA", "NRGBA", "YCbCr", "Paletted"} {
+		frames := []image.Image{even[name], odd[name]}
+		// every frame changes every pixel, so each is sent whole
+		b.Run(name, func(b *testing.B) {
+			d, _ := newTestDevice(b)
+			d.DrawRAW(frames[1])
+			b.SetBytes(240 * 240 * 2)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := d.DrawRAW(frames[i%2]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("Unchanged", func(b *testing.B) {
+		d, _ := newTestDevice(b)
+		img := even["RGBA"]
+		d.DrawRAW(img)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := d.DrawRAW(img); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -5,14 +5,14 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
-	"log"
+	"sync"
 	"time"
 
+	"github.com/kubesail/pibox-framebuffer/metrics"
 	"periph.io/x/conn/v3"
 	"periph.io/x/conn/v3/gpio"
 	"periph.io/x/conn/v3/gpio/gpioreg"
@@ -33,6 +33,9 @@ type Opts struct {
 }
 
 func NewSPI(p spi.Port, dc gpio.PinOut, opts *Opts) (*Device, error) {
+	if dc == nil {
+		return nil, errors.New("st7789: data/command pin not found")
+	}
 	if dc == gpio.INVALID {
 		return nil, errors.New("ssd1306: use nil for dc to use 3-wire mode, do not use gpio.INVALID")
 	}
@@ -46,12 +49,15 @@ func NewSPI(p spi.Port, dc gpio.PinOut, opts *Opts) (*Device, error) {
 	}
 
 	pin := gpioreg.ByName("GPIO22")
+	if pin == nil {
+		return nil, errors.New("st7789: backlight pin GPIO22 not found")
+	}
 	if err = pin.Out(gpio.Low); err != nil {
-		panic(err)
+		return nil, err
 	}
 	time.Sleep(100 * time.Millisecond)
 	if err = pin.Out(gpio.High); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return newDev(c, opts, dc)
@@ -72,6 +78,24 @@ type Device struct {
 	isBGR                         bool
 	batchLength                   int32
 	backlight                     gpio.PinIO
+
+	// frame mirrors the panel memory and next holds the frame being drawn,
+	// see frame.go
+	frame, next []byte
+	frameValid  bool
+	scratch     []byte
+	rects       rectScratch
+	// cmd holds a command or its arguments while they are sent, so that
+	// sending them does not allocate
+	cmd [4]byte
+
+	statsMu sync.Mutex
+	stats   Stats
+
+	convertTime, transferTime *metrics.Histogram
+
+	// sleepChanged is when the controller last went to sleep or woke up
+	sleepChanged time.Time
 }
 
 func (d *Device) String() string {
@@ -93,13 +117,62 @@ func (d *Device) PowerOn() error {
 	return d.backlight.Out(gpio.High)
 }
 
+// sleepDelay is how long the controller needs after SLPIN or SLPOUT before
+// it may be sent the other
+const sleepDelay = 120 * time.Millisecond
+
+// waitSleepDelay waits until the controller may change its sleep mode again
+func (d *Device) waitSleepDelay() {
+	if wait := sleepDelay - time.Since(d.sleepChanged); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Sleep switches the display off and puts the controller to sleep. The panel
+// memory keeps its contents, but nothing is shown until Wake.
+func (d *Device) Sleep() error {
+	d.waitSleepDelay()
+	if err := d.Command(DISPOFF); err != nil {
+		return err
+	}
+	if err := d.Command(SLPIN); err != nil {
+		return err
+	}
+	d.sleepChanged = time.Now()
+	return nil
+}
+
+// Wake brings the controller out of sleep, switches the display back on and
+// sends the last frame drawn again
+func (d *Device) Wake() error {
+	d.waitSleepDelay()
+	if err := d.Command(SLPOUT); err != nil {
+		return err
+	}
+	d.sleepChanged = time.Now()
+	// the supply voltages and clocks settle before the display comes on
+	time.Sleep(sleepDelay)
+	if err := d.Command(DISPON); err != nil {
+		return err
+	}
+	if !d.frameValid {
+		return nil
+	}
+	cols, rows := d.memorySize()
+	if err := d.sendMemory(d.frame, image.Rect(0, 0, cols, rows)); err != nil {
+		d.frameValid = false
+		return err
+	}
+	return nil
+}
+
 // Invert the display (black on white vs white on black).
-func (d *Device) Invert(blackOnWhite bool) {
+func (d *Device) Invert(blackOnWhite bool) error {
 	b := byte(0xA6)
 	if blackOnWhite {
 		b = 0xA7
 	}
-	d.Command(b)
+	return d.Command(b)
 }
 
 func newDev(c conn.Conn, opts *Opts, dc gpio.PinOut) (*Device, error) {
@@ -112,94 +185,105 @@ func newDev(c conn.Conn, opts *Opts, dc gpio.PinOut) (*Device, error) {
 		height:      opts.H,
 		batchLength: int32(opts.W),
 		backlight:   gpioreg.ByName("GPIO22"),
+
+		convertTime:  metrics.NewHistogram(metrics.DefaultLatencyBuckets),
+		transferTime: metrics.NewHistogram(metrics.DefaultLatencyBuckets),
 	}
 	d.batchLength = d.batchLength & 1
 
-	d.Command(SWRESET)
+	if err := d.Command(SWRESET); err != nil {
+		return nil, err
+	}
 	time.Sleep(150 * time.Millisecond)
 
-	d.Command(MADCTL)
-	d.Data(0x70)
-
-	d.Command(FRMCTR2)
-	d.SendData([]byte{0x0C, 0x0C, 0x00, 0x33, 0x33})
-
-	d.Command(COLMOD)
-	d.Data(0x05)
-
-	d.Command(GCTRL)
-	d.Data(0x14)
-
-	d.Command(VCOMS)
-	d.Data(0x37)
-
-	d.Command(LCMCTRL)
-	d.Data(0x2C)
-
-	d.Command(VDVVRHEN)
-	d.Data(0x01)
-
-	d.Command(VRHS)
-	d.Data(0x12)
-
-	d.Command(VDVS)
-	d.Data(0x20)
-
-	d.Command(0xD0)
-	d.SendData([]byte{0xA4, 0xA1})
-
-	d.Command(FRCTRL2)
-	d.Data(0x0F)
-
-	d.Command(GMCTRP1)
-	d.SendData([]byte{0xD0, 0x04, 0x0D, 0x11, 0x13, 0x2B, 0x3F, 0x54, 0x4C, 0x18, 0x0D, 0x0B, 0x1F, 0x23})
-
-	d.Command(GMCTRN1)
-	d.SendData([]byte{0xD0, 0x04, 0x0C, 0x11, 0x13, 0x2C, 0x3F, 0x44, 0x51, 0x2F, 0x1F, 0x1F, 0x20, 0x23})
-
-	d.Command(INVON)
-
-	d.Command(SLPOUT)
-
-	d.Command(DISPON)
+	seq := []struct {
+		cmd  uint8
+		data []byte
+	}{
+		{MADCTL, []byte{0x70}},
+		{FRMCTR2, []byte{0x0C, 0x0C, 0x00, 0x33, 0x33}},
+		{COLMOD, []byte{0x05}},
+		{GCTRL, []byte{0x14}},
+		{VCOMS, []byte{0x37}},
+		{LCMCTRL, []byte{0x2C}},
+		{VDVVRHEN, []byte{0x01}},
+		{VRHS, []byte{0x12}},
+		{VDVS, []byte{0x20}},
+		{0xD0, []byte{0xA4, 0xA1}},
+		{FRCTRL2, []byte{0x0F}},
+		{GMCTRP1, []byte{0xD0, 0x04, 0x0D, 0x11, 0x13, 0x2B, 0x3F, 0x54, 0x4C, 0x18, 0x0D, 0x0B, 0x1F, 0x23}},
+		{GMCTRN1, []byte{0xD0, 0x04, 0x0C, 0x11, 0x13, 0x2C, 0x3F, 0x44, 0x51, 0x2F, 0x1F, 0x1F, 0x20, 0x23}},
+		{INVON, nil},
+		{SLPOUT, nil},
+		{DISPON, nil},
+	}
+	for _, i := range seq {
+		if err := d.Command(i.cmd); err != nil {
+			return nil, err
+		}
+		if len(i.data) == 0 {
+			continue
+		}
+		if err := d.SendData(i.data); err != nil {
+			return nil, err
+		}
+	}
 
 	return d, nil
 }
 
-func (d *Device) SetWindow() {
-	x1 := d.width - 1
-	y1 := d.height - 1
-	y0 := 0
-	x0 := 0
+// SetWindow selects the whole screen for the next RAMWR
+func (d *Device) SetWindow() error {
+	return d.setWindow(0, d.width-1, 0, d.height-1)
+}
 
-	d.Command(CASET)
-	d.Data(byte(x0 >> 8))
-	d.Data(byte(x0 & 0xFF))
-	d.Data(byte(x1 >> 8))
-	d.Data(byte(x1 & 0xFF))
+// setWindow sets the column and row address window (inclusive, in panel
+// memory coordinates) and starts a RAMWR. Pixel data sent afterwards fills
+// the window column by column within each row, high byte first.
+func (d *Device) setWindow(x0, x1, y0, y1 int16) error {
+	if err := d.Command(CASET); err != nil {
+		return err
+	}
+	d.cmd = [4]byte{byte(x0 >> 8), byte(x0 & 0xFF), byte(x1 >> 8), byte(x1 & 0xFF)}
+	if err := d.SendData(d.cmd[:]); err != nil {
+		return err
+	}
 
-	d.Command(RASET)
-	d.Data(byte(y0 >> 8))
-	d.Data(byte(y0 & 0xFF))
-	d.Data(byte(y1 >> 8))
-	d.Data(byte(y1 & 0xFF))
+	if err := d.Command(RASET); err != nil {
+		return err
+	}
+	d.cmd = [4]byte{byte(y0 >> 8), byte(y0 & 0xFF), byte(y1 >> 8), byte(y1 & 0xFF)}
+	if err := d.SendData(d.cmd[:]); err != nil {
+		return err
+	}
 
-	d.Command(RAMWR)
-	d.Data(0x89)
+	return d.Command(RAMWR)
 }
 
 func (d *Device) SendData(c []byte) error {
 	if err := d.dc.Out(gpio.High); err != nil {
 		return err
 	}
-	return d.c.Tx(c, nil)
+	return d.tx(c)
 }
 
 func (d *Device) SendCommand(c []byte) error {
 	if err := d.dc.Out(gpio.Low); err != nil {
 		return err
 	}
-	return d.c.Tx(c, nil)
+	return d.tx(c)
+}
+
+// tx makes one SPI transfer, counting it in the stats
+func (d *Device) tx(c []byte) error {
+	err := d.c.Tx(c, nil)
+	d.statsMu.Lock()
+	d.stats.Transfers++
+	if err != nil {
+		d.stats.TransferErrors++
+	}
+	d.statsMu.Unlock()
+	return err
 }
 
 // FillRectangle fills a rectangle at a given coordinates with a color
@@ -209,26 +293,7 @@ func (d *Device) FillRectangle(x, y, width, height int16, c color.RGBA) error {
 		x >= k || (x+width) > k || y >= i || (y+height) > i {
 		return errors.New("rectangle coordinates outside display area")
 	}
-	d.SetWindow()
-	c565 := RGBATo565(c)
-	c1 := uint8(c565)
-	c2 := uint8(c565 >> 8)
-
-	data := make([]uint8, 240*2)
-	for i := int32(0); i < 240; i++ {
-		data[i*2] = c1
-		data[i*2+1] = c2
-	}
-	j := int32(width) * int32(height)
-	for j > 0 {
-		if j >= 240 {
-			d.SendData(data)
-		} else {
-			d.SendData(data[:j*2])
-		}
-		j -= 240
-	}
-	return nil
+	return d.DrawRegion(image.Rect(int(x), int(y), int(x+width), int(y+height)), &image.Uniform{c})
 }
 
 // Size returns the current size of the display.
@@ -248,26 +313,25 @@ func RGBATo565(c color.RGBA) uint16 {
 }
 
 // SetPixel sets a pixel in the screen
-func (d *Device) SetPixel(x int16, y int16, c color.RGBA) {
+func (d *Device) SetPixel(x int16, y int16, c color.RGBA) error {
 	if x < 0 || y < 0 ||
 		(((d.rotation == NO_ROTATION || d.rotation == ROTATION_180) && (x >= d.width || y >= d.height)) ||
 			((d.rotation == ROTATION_90 || d.rotation == ROTATION_270) && (x >= d.height || y >= d.width))) {
-		return
+		return nil
 	}
-	d.FillRectangle(x, y, 1, 1, c)
+	return d.FillRectangle(x, y, 1, 1, c)
 }
 
 // FillScreen fills the screen with a given color
-func (d *Device) FillScreen(c color.RGBA) {
+func (d *Device) FillScreen(c color.RGBA) error {
 	if d.rotation == NO_ROTATION || d.rotation == ROTATION_180 {
-		d.FillRectangle(0, 0, d.width, d.height, c)
-	} else {
-		d.FillRectangle(0, 0, d.height, d.width, c)
+		return d.FillRectangle(0, 0, d.width, d.height, c)
 	}
+	return d.FillRectangle(0, 0, d.height, d.width, c)
 }
 
 // SetRotation changes the rotation of the device (clock-wise)
-func (d *Device) SetRotation(rotation Rotation) {
+func (d *Device) SetRotation(rotation Rotation) error {
 	madctl := uint8(0)
 	switch rotation % 4 {
 	case 0:
@@ -293,8 +357,10 @@ func (d *Device) SetRotation(rotation Rotation) {
 	if d.isBGR {
 		madctl |= MADCTL_BGR
 	}
-	d.Command(MADCTL)
-	d.Data(madctl)
+	if err := d.Command(MADCTL); err != nil {
+		return err
+	}
+	return d.Data(madctl)
 }
 
 // IsBGR changes the color mode (RGB/BGR)
@@ -303,68 +369,114 @@ func (d *Device) IsBGR(bgr bool) {
 }
 
 // InverColors inverts the colors of the screen
-func (d *Device) InvertColors(invert bool) {
+func (d *Device) InvertColors(invert bool) error {
 	if invert {
-		d.Command(INVON)
-	} else {
-		d.Command(INVOFF)
+		return d.Command(INVON)
 	}
+	return d.Command(INVOFF)
 }
 
 // Command sends a command to the device
-func (d *Device) Command(cmd uint8) {
-	d.SendCommand([]byte{cmd})
+func (d *Device) Command(cmd uint8) error {
+	d.cmd[0] = cmd
+	return d.SendCommand(d.cmd[:1])
 }
 
 // Data sends data to the device
-func (d *Device) Data(data uint8) {
-	d.SendData([]byte{data})
+func (d *Device) Data(data uint8) error {
+	d.cmd[0] = data
+	return d.SendData(d.cmd[:1])
 }
 
 // DrawFastVLine draws a vertical line faster than using SetPixel
-func (d *Device) DrawFastVLine(x, y0, y1 int16, c color.RGBA) {
+func (d *Device) DrawFastVLine(x, y0, y1 int16, c color.RGBA) error {
 	if y0 > y1 {
 		y0, y1 = y1, y0
 	}
-	d.FillRectangle(x, y0, 1, y1-y0+1, c)
+	return d.FillRectangle(x, y0, 1, y1-y0+1, c)
 }
 
 // DrawFastHLine draws a horizontal line faster than using SetPixel
-func (d *Device) DrawFastHLine(x0, x1, y int16, c color.RGBA) {
+func (d *Device) DrawFastHLine(x0, x1, y int16, c color.RGBA) error {
 	if x0 > x1 {
 		x0, x1 = x1, x0
 	}
-	d.FillRectangle(x0, y, x1-x0+1, 1, c)
+	return d.FillRectangle(x0, y, x1-x0+1, 1, c)
 }
 
-func (d *Device) DrawImage(reader io.Reader) {
-	d.SetWindow()
+func (d *Device) DrawImage(reader io.Reader) error {
 	img, _, err := image.Decode(reader)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	d.DrawRAW(img)
+	return d.DrawRAW(img)
 }
 
-func (d *Device) DrawRAW(img image.Image) {
-	d.SetWindow()
-	rect := img.Bounds()
-	rgbaimg := image.NewRGBA(rect)
-	draw.Draw(rgbaimg, rect, img, rect.Min, draw.Src)
+// DrawRAW draws a full frame. Only the parts of the panel that changed since
+// the previous frame are sent.
+func (d *Device) DrawRAW(img image.Image) error {
+	start := time.Now()
+	d.ensureBuffers()
+	d.convert(d.next, d.rect, img, img.Bounds().Min)
+
+	cols, rows := d.memorySize()
+	full := image.Rect(0, 0, cols, rows)
+	rects := []image.Rectangle{full}
+	if d.frameValid {
+		rects = dirtyRects(d.frame, d.next, cols, rows, &d.rects)
+	}
+	area := 0
+	for _, r := range rects {
+		area += r.Dx() * r.Dy()
+	}
+	if area*10 >= cols*rows*9 {
+		// a single window is cheaper when nearly everything changed
+		rects = []image.Rectangle{full}
+		area = cols * rows
+	}
+	d.convertTime.ObserveDuration(time.Since(start))
 
-	np := []uint8{}
-	for i := 0; i < 240; i++ {
-		for j := 0; j < 240; j++ {
-			rgba := rgbaimg.At(int(d.width)-i, j).(color.RGBA)
-			c565 := RGBATo565(rgba)
-			c1 := uint8(c565)
-			c2 := uint8(c565 >> 8)
-			np = append(np, c1, c2)
+	start = time.Now()
+	for _, r := range rects {
+		if err := d.sendMemory(d.next, r); err != nil {
+			d.frameValid = false
+			return err
 		}
 	}
+	d.transferTime.ObserveDuration(time.Since(start))
+	d.frame, d.next = d.next, d.frame
+	d.frameValid = true
+
+	d.statsMu.Lock()
+	d.stats.Frames++
+	d.stats.BytesSaved += uint64((cols*rows - area) * 2)
+	d.statsMu.Unlock()
+	return nil
+}
 
-	for i := 0; i < len(np); i += 4096 {
-		d.SendData(np[i : i+4096])
+// DrawRegion draws img into rect, leaving the rest of the screen untouched.
+// The top left of img is drawn at rect.Min, and rect is clipped to the screen.
+func (d *Device) DrawRegion(rect image.Rectangle, img image.Image) error {
+	src := img.Bounds().Min
+	clipped := rect.Intersect(d.rect)
+	if clipped.Empty() {
+		return nil
+	}
+	src = src.Add(clipped.Min.Sub(rect.Min))
+	rect = clipped
+
+	start := time.Now()
+	d.ensureBuffers()
+	d.convert(d.frame, rect, img, src)
+	d.convertTime.ObserveDuration(time.Since(start))
+
+	start = time.Now()
+	if err := d.sendMemory(d.frame, d.memoryRect(rect)); err != nil {
+		// the mirror holds pixels the panel may not have received
+		d.frameValid = false
+		return err
 	}
+	d.transferTime.ObserveDuration(time.Since(start))
+	return nil
 }